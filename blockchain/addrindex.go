@@ -0,0 +1,222 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"zeechain/wallet"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	addrIndexPrefix = []byte("ai-")
+	// set while the address index is kept up to date
+	addrIndexKey = []byte("addrindex")
+)
+
+var ErrNoAddressIndex = errors.New("address index is not enabled")
+
+// AddressTx is a transaction touching an address. Delta is what the address
+// received in it minus what it spent.
+type AddressTx struct {
+	TxID   []byte
+	Height int
+	Delta  int64
+}
+
+type addrEntry struct {
+	key   []byte
+	value []byte
+}
+
+// scriptAddressKey identifies the address an output script pays to by its
+// version byte and hash, nil when it pays to no address.
+func scriptAddressKey(script []byte) []byte {
+	if hash := ExtractPubKeyHash(script); hash != nil {
+		return append([]byte{wallet.Version}, hash...)
+	}
+	if hash := ExtractScriptHash(script); hash != nil {
+		return append([]byte{wallet.ScriptVersion}, hash...)
+	}
+	return nil
+}
+
+func addrPrefix(address []byte) []byte {
+	version, hash := wallet.DecodeAddress(address)
+	key := append([]byte{}, addrIndexPrefix...)
+	return append(append(key, version), hash...)
+}
+
+// addrEntryKey orders the entries of an address by height, then position in
+// the block.
+func addrEntryKey(addrKey []byte, height, pos int) []byte {
+	key := append(append([]byte{}, addrIndexPrefix...), addrKey...)
+	key = binary.BigEndian.AppendUint64(key, uint64(height))
+	return binary.BigEndian.AppendUint32(key, uint32(pos))
+}
+
+// addressEntries works out the index entries of a main chain block. Spent
+// outputs are found through the transaction index, or in the block itself
+// when an earlier transaction of it created them.
+func (chain *Blockchain) addressEntries(block *Block) ([]addrEntry, error) {
+	var entries []addrEntry
+	created := make(map[string]*Transaction)
+	for pos, tx := range block.Transactions {
+		deltas := make(map[string]int64)
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				prevTx, ok := created[hex.EncodeToString(in.ID)]
+				if !ok {
+					found, err := chain.FindTransction(in.ID)
+					if err != nil {
+						return nil, err
+					}
+					prevTx = &found
+				}
+				if in.OutId < 0 || int(in.OutId) >= len(prevTx.Outputs) {
+					return nil, ErrMissingInput
+				}
+				out := prevTx.Outputs[in.OutId]
+				if addr := scriptAddressKey(out.ScriptPubKey); addr != nil {
+					deltas[string(addr)] -= int64(out.Value)
+				}
+			}
+		}
+		for _, out := range tx.Outputs {
+			if addr := scriptAddressKey(out.ScriptPubKey); addr != nil {
+				deltas[string(addr)] += int64(out.Value)
+			}
+		}
+		created[hex.EncodeToString(tx.ID)] = tx
+		for addr, delta := range deltas {
+			e := newEncoder()
+			e.bytes(tx.ID)
+			e.int64(delta)
+			entries = append(entries, addrEntry{addrEntryKey([]byte(addr), block.Height, pos), e.Bytes()})
+		}
+	}
+	return entries, nil
+}
+
+func decodeAddrEntry(key, value []byte) (AddressTx, error) {
+	var atx AddressTx
+	d := newDecoder(value)
+	atx.TxID = d.bytes()
+	atx.Delta = d.int64()
+	if err := d.finish(); err != nil {
+		return atx, err
+	}
+	atx.Height = int(binary.BigEndian.Uint64(key[len(key)-12:]))
+	return atx, nil
+}
+
+// AddressIndexEnabled reports whether connected blocks update the address
+// index.
+func (chain *Blockchain) AddressIndexEnabled() bool {
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(addrIndexKey)
+		return err
+	})
+	if err != nil && err != badger.ErrKeyNotFound {
+		log.Panic(err)
+	}
+	return err == nil
+}
+
+// EnableAddressIndex builds the address index from the main chain and keeps
+// it up to date as blocks are connected and disconnected.
+func (chain *Blockchain) EnableAddressIndex() error {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	u := UTXOSet{chain}
+	u.DeleteByPrefix(addrIndexPrefix)
+	iter := chain.Iterator()
+	for {
+		block := iter.Next()
+		entries, err := chain.addressEntries(block)
+		if err != nil {
+			return err
+		}
+		err = chain.Db.Update(func(txn *badger.Txn) error {
+			for _, entry := range entries {
+				if err := txn.Set(entry.key, entry.value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return chain.Db.Update(func(txn *badger.Txn) error {
+		return txn.Set(addrIndexKey, []byte{})
+	})
+}
+
+// AddressHistory returns up to limit transactions touching address, newest
+// first, after skipping the skip newest ones.
+func (chain *Blockchain) AddressHistory(address []byte, skip, limit int) ([]AddressTx, error) {
+	if !chain.AddressIndexEnabled() {
+		return nil, ErrNoAddressIndex
+	}
+	var history []AddressTx
+	prefix := addrPrefix(address)
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(append(prefix, 0xff)); it.ValidForPrefix(prefix) && len(history) < limit; it.Next() {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			item := it.Item()
+			err := item.Value(func(val []byte) error {
+				atx, err := decodeAddrEntry(item.Key(), val)
+				history = append(history, atx)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return history, err
+}
+
+// AddressSummary returns the number of transactions touching address and
+// the sum of their deltas, which is its balance.
+func (chain *Blockchain) AddressSummary(address []byte) (int, int64, error) {
+	if !chain.AddressIndexEnabled() {
+		return 0, 0, ErrNoAddressIndex
+	}
+	count := 0
+	var balance int64
+	prefix := addrPrefix(address)
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			err := item.Value(func(val []byte) error {
+				atx, err := decodeAddrEntry(item.Key(), val)
+				balance += atx.Delta
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, balance, err
+}
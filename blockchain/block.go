@@ -1,20 +1,77 @@
 package blockchain
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/sha256"
 	"io"
 	"log"
 	"time"
 )
 
+const BlockVersion = 1
+
+// BlockHeader holds everything the proof of work commits to. Transactions
+// are committed to through MerkleRoot.
+type BlockHeader struct {
+	Version    int
+	PrevHash   []byte
+	MerkleRoot []byte
+	TimeStamp  int64
+	Bits       uint32
+	Nonce      int
+	Height     int
+}
+
 type Block struct {
-	TimeStamp    int64
+	BlockHeader
 	Hash         []byte
 	Transactions []*Transaction
-	PrevHash     []byte
-	Nonce        int
-	Height       int
+}
+
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(NewProof(h).InitData(h.Nonce))
+	return hash[:]
+}
+
+func (h *BlockHeader) encode(e *encoder) {
+	e.int64(int64(h.Version))
+	e.bytes(h.PrevHash)
+	e.bytes(h.MerkleRoot)
+	e.int64(h.TimeStamp)
+	e.uint32(h.Bits)
+	e.int64(int64(h.Nonce))
+	e.int64(int64(h.Height))
+}
+
+func (h *BlockHeader) decode(d *decoder) {
+	h.Version = int(d.int64())
+	h.PrevHash = d.bytes()
+	h.MerkleRoot = d.bytes()
+	h.TimeStamp = d.int64()
+	h.Bits = d.uint32()
+	h.Nonce = int(d.int64())
+	h.Height = int(d.int64())
+}
+
+func (h *BlockHeader) Serialize() []byte {
+	e := newEncoder()
+	h.encode(e)
+	return e.Bytes()
+}
+
+func DecodeHeader(data []byte) (*BlockHeader, error) {
+	var h BlockHeader
+	d := newDecoder(data)
+	h.decode(d)
+	return &h, d.finish()
+}
+
+func DeserializeHeader(data []byte) *BlockHeader {
+	h, err := DecodeHeader(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return h
 }
 
 func (b *Block) HashTransactions() []byte {
@@ -29,33 +86,82 @@ func (b *Block) HashTransactions() []byte {
 	return tree.RootNode.Data
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-	pow := NewProof(block)
-	block.Nonce, block.Hash = pow.Run()
-	return block
+// CreateBlock mines a block on prevHash, timestamped no earlier than
+// minTime. When the nonce space runs out the timestamp is refreshed, or if
+// it has not moved the coinbase extra nonce is bumped, and mining starts
+// over.
+func CreateBlock(ctx context.Context, txs []*Transaction, prevHash []byte, height int, bits uint32, minTime int64) (*Block, error) {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:  BlockVersion,
+			PrevHash: prevHash,
+			Bits:     bits,
+			Height:   height,
+		},
+		Transactions: txs,
+	}
+	extraNonce := uint64(0)
+	for {
+		now := max(time.Now().Unix(), minTime)
+		if now == block.TimeStamp && len(txs) > 0 && txs[0].IsCoinbase() {
+			extraNonce++
+			txs[0].setExtraNonce(extraNonce)
+		}
+		block.TimeStamp = now
+		block.MerkleRoot = block.HashTransactions()
+		pow := NewProof(&block.BlockHeader)
+		nonce, hash, err := pow.Run(ctx)
+		if err == nil {
+			block.Nonce, block.Hash = nonce, hash
+			return block, nil
+		}
+		if err != ErrNonceExhausted {
+			return nil, err
+		}
+	}
 }
 
 func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+	block, err := CreateBlock(context.Background(), []*Transaction{coinbase}, []byte{}, 0, InitialBits, 0)
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
 }
 
 func (b *Block) Serialize() []byte {
-	var buf bytes.Buffer
-	encode := gob.NewEncoder(&buf)
-	err := encode.Encode(b)
-	if err != nil {
-		log.Panic(err)
+	e := newEncoder()
+	b.BlockHeader.encode(e)
+	e.bytes(b.Hash)
+	e.uint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		tx.encode(e)
 	}
-	return buf.Bytes()
+	return e.Bytes()
 }
 
-func DeserializeBlock(in io.Reader) *Block {
+func DecodeBlock(data []byte) (*Block, error) {
 	var block Block
-	decode := gob.NewDecoder(in)
-	err := decode.Decode(&block)
+	d := newDecoder(data)
+	block.BlockHeader.decode(d)
+	block.Hash = d.bytes()
+	n := d.length()
+	for i := 0; i < n && d.err == nil; i++ {
+		tx := &Transaction{}
+		tx.decode(d)
+		block.Transactions = append(block.Transactions, tx)
+	}
+	return &block, d.finish()
+}
+
+func DeserializeBlock(in io.Reader) *Block {
+	data, err := io.ReadAll(in)
 	if err != nil {
 		log.Panic(err)
 	}
-	return &block
+	block, err := DecodeBlock(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
 }
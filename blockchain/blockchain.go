@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/dgraph-io/badger"
 )
@@ -17,11 +19,22 @@ import (
 const (
 	dbPath      = "blocks_"
 	genesisData = "First Transaction from Genesis"
+
+	// DBVersion is the layout of the database: the record encodings and the
+	// keys they are stored under. A database of another version is refused
+	// rather than misread.
+	DBVersion = 1
+)
+
+var (
+	versionKey  = []byte("dbversion")
+	blockPrefix = []byte("blk-")
 )
 
 type Blockchain struct {
 	LastHash []byte
 	Db       *badger.DB
+	lock     sync.Mutex
 }
 
 func DBExists(path string) bool {
@@ -38,6 +51,7 @@ func ContinueBlockChain(nodeId string) *Blockchain {
 	if err != nil {
 		log.Fatal(err)
 	}
+	checkVersion(db, path)
 	var lastHash []byte
 	err = db.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
@@ -56,7 +70,39 @@ func ContinueBlockChain(nodeId string) *Blockchain {
 	if err != nil {
 		log.Panic(err)
 	}
-	return &Blockchain{lastHash, db}
+	return &Blockchain{LastHash: lastHash, Db: db}
+}
+
+// checkVersion refuses a database written in another layout. Chains from
+// before the layout was versioned hash their blocks differently, so they
+// cannot be converted and have to be synced again.
+func checkVersion(db *badger.DB, path string) {
+	version := -1
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(versionKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) == 1 {
+				version = int(val[0])
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if version != DBVersion {
+		db.Close()
+		if version < 0 {
+			log.Fatalf("the database in %s predates versioned storage and cannot be read, delete it and create or sync the chain again", path)
+		}
+		log.Fatalf("the database in %s has version %d, this build reads version %d", path, version, DBVersion)
+	}
 }
 
 func InitBlockChain(address, nodeId string) *Blockchain {
@@ -71,10 +117,14 @@ func InitBlockChain(address, nodeId string) *Blockchain {
 		log.Panic(err)
 	}
 	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinBaseTx(address, genesisData)
+		cbtx := CoinBaseTx(address, genesisData, 0, 0)
 		genesis := Genesis(cbtx)
 		fmt.Println("Created genesis block")
-		err = txn.Set(genesis.Hash, genesis.Serialize())
+		err = txn.Set(versionKey, []byte{DBVersion})
+		if err != nil {
+			return err
+		}
+		err = txn.Set(append(blockPrefix, genesis.Hash...), genesis.Serialize())
 		if err != nil {
 			log.Panic(err)
 		}
@@ -83,91 +133,92 @@ func InitBlockChain(address, nodeId string) *Blockchain {
 		if err != nil {
 			return err
 		}
-		return nil
+		err = txn.Set(append(headerPrefix, genesis.Hash...), genesis.BlockHeader.Serialize())
+		if err != nil {
+			return err
+		}
+		err = txn.Set(heightKey(0), genesis.Hash)
+		if err != nil {
+			return err
+		}
+		err = indexTransactions(txn, genesis)
+		if err != nil {
+			return err
+		}
+		return putIndex(txn, newBlockIndex(&genesis.BlockHeader, genesis.Hash, nil))
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 	return &Blockchain{
-		lastHash,
-		db,
+		LastHash: lastHash,
+		Db:       db,
 	}
 }
 
-func (chain *Blockchain) AddBlock(b *Block) {
+// AddBlock stores a block and indexes it. If the block's branch now has more
+// cumulative work than the main chain, the chain reorganizes onto it.
+func (chain *Blockchain) AddBlock(b *Block) error {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	if bi, err := chain.GetBlockIndex(b.Hash); err == nil && !bi.HeaderOnly {
+		//exists
+		return nil
+	}
+	if err := chain.ValidateBlock(b); err != nil {
+		return err
+	}
+	var bi *BlockIndex
 	err := chain.Db.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(b.Hash); err != badger.ErrKeyNotFound {
-			//exists
-			return nil
-		}
-		blockData := b.Serialize()
-		err := txn.Set(b.Hash, blockData)
-		if err != nil {
-			log.Panic(err)
-		}
-		item, err := txn.Get(chain.LastHash)
+		parent, err := getIndex(txn, b.PrevHash)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		var lastBlock *Block
-		err = item.Value(func(val []byte) error {
-			lastBlock = DeserializeBlock(bytes.NewReader(val))
-			return nil
-		})
-		if err != nil {
-			log.Panic(err)
+		bi = newBlockIndex(&b.BlockHeader, b.Hash, parent)
+		if err := txn.Set(append(blockPrefix, b.Hash...), b.Serialize()); err != nil {
+			return err
 		}
-		if b.Height > lastBlock.Height {
-			err := txn.Set([]byte("lh"), b.Hash)
-			if err != nil {
-				log.Panic(err)
-			}
-			chain.LastHash = b.Hash
+		if err := txn.Set(append(headerPrefix, b.Hash...), b.BlockHeader.Serialize()); err != nil {
+			return err
 		}
-		return nil
+		return putIndex(txn, bi)
 	})
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	tip, err := chain.GetBlockIndex(chain.LastHash)
+	if err != nil {
+		return err
+	}
+	if bi.ChainWork().Cmp(tip.ChainWork()) <= 0 {
+		return nil
+	}
+	return chain.setTip(b.Hash)
 }
 
 func (chain *Blockchain) GetBestHeight() int {
-	db := chain.Db
-	var Height int
-	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return nil
-			}
-		}
-		err = item.Value(func(val []byte) error {
-			lb := DeserializeBlock(bytes.NewReader(val))
-			Height = lb.Height
-			return nil
-		})
-		return err
-	})
+	tip, err := chain.GetBlockIndex(chain.LastHash)
 	if err != nil {
 		log.Panic(err)
 	}
-	return Height
+	return tip.Height
 }
+
 func (chain *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 	err := chain.Db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(blockHash)
+		item, err := txn.Get(append(blockPrefix, blockHash...))
 		if err != nil {
 			return err
 		}
-		err = item.Value(func(val []byte) error {
-			block = *DeserializeBlock(bytes.NewReader(val))
+		return item.Value(func(val []byte) error {
+			decoded, err := DecodeBlock(val)
+			if err != nil {
+				return err
+			}
+			block = *decoded
 			return nil
 		})
-		if err != nil {
-			return err
-		}
-		return nil
 	})
 	if err != nil {
 		return block, err
@@ -190,138 +241,106 @@ func (chain *Blockchain) GetBlockHashes() [][]byte {
 
 }
 
-func (chain *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
-	var lashHash []byte
-	var lastHeight int
+// MineBlock mines the transactions into a block on the current tip and adds
+// it to the chain. Transactions may spend outputs of those before them in
+// the list. Cancelling ctx abandons the search.
+func (chain *Blockchain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	tip, err := chain.GetBlockIndex(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+	created := make(map[string]Transaction)
+	spent := make(map[string]bool)
 	for _, tx := range transactions {
-		if !chain.VerifyTransactions(tx) {
-			return nil, errors.New("invalid transaction")
+		if !tx.IsCoinbase() {
+			if _, err := chain.checkTxInputs(tx, tip.Height+1, created, spent); err != nil {
+				return nil, err
+			}
 		}
+		created[hex.EncodeToString(tx.ID)] = *tx
 	}
-	err := chain.Db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
-			return err
-		}
-		err = item.Value(func(val []byte) error {
-			lashHash = val
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-		item, err = txn.Get(lashHash)
-		if err != nil {
-			return err
-		}
-		var lastBlock *Block
-		err = item.Value(func(val []byte) error {
-			lastBlock = DeserializeBlock(bytes.NewReader(val))
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-		lastHeight = lastBlock.Height
-		return nil
-	})
+	bits, err := chain.NextBits(tip)
 	if err != nil {
 		return nil, err
 	}
-	newBlock := CreateBlock(transactions, lashHash, lastHeight+1)
-	err = chain.Db.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		if err != nil {
-			return nil
-		}
-		err = txn.Set([]byte("lh"), newBlock.Hash)
-		if err != nil {
-			return nil
-		}
-		chain.LastHash = newBlock.Hash
-		return nil
-	})
+	mtp, err := chain.medianTime(tip)
 	if err != nil {
 		return nil, err
 	}
+	newBlock, err := CreateBlock(ctx, transactions, tip.Hash, tip.Height+1, bits, mtp+1)
+	if err != nil {
+		return nil, err
+	}
+	if err := chain.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
 	return newBlock, nil
 }
 
+// FindTransction returns a transaction of the main chain, found through
+// the transaction index.
 func (chain *Blockchain) FindTransction(Id []byte) (Transaction, error) {
-	iter := chain.Iterator()
-	for {
-		block := iter.Next()
-		for _, tx := range block.Transactions {
-			if bytes.Equal(tx.ID, Id) {
-				return *tx, nil
-			}
-		}
-		if len(block.PrevHash) == 0 {
-			break
-		}
+	loc, err := chain.GetTxLocation(Id)
+	if err == badger.ErrKeyNotFound {
+		return Transaction{}, errors.New("Transaction not found")
 	}
-	return Transaction{}, errors.New("Transaction not found")
-}
-
-func (chain *Blockchain) SignTransactions(tx *Transaction, privKey *ecdsa.PrivateKey) error {
-	prevTxs := make(map[string]Transaction)
-	for _, in := range tx.Inputs {
-		prevTx, err := chain.FindTransction(in.ID)
-		if err != nil {
-			return err
-		}
-		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
+	if err != nil {
+		return Transaction{}, err
 	}
-	return tx.Sign(*privKey, prevTxs)
+	block, err := chain.GetBlock(loc.BlockHash)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if loc.Position >= len(block.Transactions) || !bytes.Equal(block.Transactions[loc.Position].ID, Id) {
+		return Transaction{}, fmt.Errorf("transaction index is out of date for %x, run reindextx", Id)
+	}
+	return *block.Transactions[loc.Position], nil
 }
 
-func (chain *Blockchain) VerifyTransactions(tx *Transaction) bool {
-	if tx.IsCoinbase() {
-		return true
-	}
+// SignTransactions signs every input of tx with the key its spent output is
+// locked to, which must be among privKeys, covering what hashType says.
+func (chain *Blockchain) SignTransactions(tx *Transaction, hashType SigHashType, privKeys ...*ecdsa.PrivateKey) error {
 	prevTxs := make(map[string]Transaction)
 	for _, in := range tx.Inputs {
 		prevTx, err := chain.FindTransction(in.ID)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
 	}
-	v, err := tx.Verify(prevTxs)
-	if err != nil {
-		log.Panic(err)
+	keys := make([]ecdsa.PrivateKey, len(privKeys))
+	for i, privKey := range privKeys {
+		keys[i] = *privKey
 	}
-	return v
-
+	return tx.SignWithKeys(keys, prevTxs, hashType)
 }
 
-func (chain *Blockchain) FindUTXO() map[string]TransOutputs {
-	UTXO := make(map[string]TransOutputs)
-	spentTXOs := make(map[string][]int)
+// FindUTXO walks the main chain from the tip and returns the outputs no
+// later transaction spends.
+func (chain *Blockchain) FindUTXO() []UTXOEntry {
+	var UTXO []UTXOEntry
+	spentTXOs := make(map[string]bool)
 
 	iter := chain.Iterator()
 	for {
 		block := iter.Next()
 
 		for _, tx := range block.Transactions {
-			txId := hex.EncodeToString(tx.ID)
-		Outputs:
 			for outIdx, out := range tx.Outputs {
-				if spentTXOs[txId] != nil {
-					for _, spentOut := range spentTXOs[txId] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
+				if IsUnspendable(out.ScriptPubKey) || spentTXOs[fmt.Sprintf("%x:%d", tx.ID, outIdx)] {
+					continue
 				}
-				outs := UTXO[txId]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txId] = outs
+				UTXO = append(UTXO, UTXOEntry{
+					TxID:     tx.ID,
+					Index:    outIdx,
+					Output:   out,
+					Height:   block.Height,
+					Coinbase: tx.IsCoinbase(),
+				})
 			}
 			if !tx.IsCoinbase() {
 				for _, in := range tx.Inputs {
-					inTxId := hex.EncodeToString(in.ID)
-					spentTXOs[inTxId] = append(spentTXOs[inTxId], int(in.OutId))
+					spentTXOs[fmt.Sprintf("%x:%d", in.ID, in.OutId)] = true
 				}
 			}
 		}
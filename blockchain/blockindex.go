@@ -0,0 +1,239 @@
+package blockchain
+
+import (
+	"bytes"
+	"log"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	indexPrefix  = []byte("bi-")
+	heightPrefix = []byte("mh-")
+)
+
+// BlockIndex is stored for every block we know about, on the main chain or
+// not. Work is the cumulative proof of work up to and including the block.
+// HeaderOnly is set while we have the header but not yet the transactions.
+type BlockIndex struct {
+	Hash       []byte
+	PrevHash   []byte
+	Height     int
+	TimeStamp  int64
+	Bits       uint32
+	Work       []byte
+	Invalid    bool
+	HeaderOnly bool
+}
+
+func (bi *BlockIndex) ChainWork() *big.Int {
+	return new(big.Int).SetBytes(bi.Work)
+}
+
+func (bi *BlockIndex) Serialize() []byte {
+	e := newEncoder()
+	e.bytes(bi.Hash)
+	e.bytes(bi.PrevHash)
+	e.int64(int64(bi.Height))
+	e.int64(bi.TimeStamp)
+	e.uint32(bi.Bits)
+	e.bytes(bi.Work)
+	e.bool(bi.Invalid)
+	e.bool(bi.HeaderOnly)
+	return e.Bytes()
+}
+
+func DecodeBlockIndex(data []byte) (*BlockIndex, error) {
+	var bi BlockIndex
+	d := newDecoder(data)
+	bi.Hash = d.bytes()
+	bi.PrevHash = d.bytes()
+	bi.Height = int(d.int64())
+	bi.TimeStamp = d.int64()
+	bi.Bits = d.uint32()
+	bi.Work = d.bytes()
+	bi.Invalid = d.bool()
+	bi.HeaderOnly = d.bool()
+	return &bi, d.finish()
+}
+
+func newBlockIndex(h *BlockHeader, hash []byte, parent *BlockIndex) *BlockIndex {
+	work := NewProof(h).Work()
+	if parent != nil {
+		work.Add(work, parent.ChainWork())
+	}
+	return &BlockIndex{
+		Hash:      hash,
+		PrevHash:  h.PrevHash,
+		Height:    h.Height,
+		TimeStamp: h.TimeStamp,
+		Bits:      h.Bits,
+		Work:      work.Bytes(),
+	}
+}
+
+func getIndex(txn *badger.Txn, hash []byte) (*BlockIndex, error) {
+	item, err := txn.Get(append(indexPrefix, hash...))
+	if err != nil {
+		return nil, err
+	}
+	var bi *BlockIndex
+	err = item.Value(func(val []byte) error {
+		bi, err = DecodeBlockIndex(val)
+		return err
+	})
+	return bi, err
+}
+
+func putIndex(txn *badger.Txn, bi *BlockIndex) error {
+	return txn.Set(append(indexPrefix, bi.Hash...), bi.Serialize())
+}
+
+func heightKey(height int) []byte {
+	return append(heightPrefix, ToHex(int64(height))...)
+}
+
+// GetMainHash returns the hash of the main chain block at height.
+func (chain *Blockchain) GetMainHash(height int) ([]byte, error) {
+	var hash []byte
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightKey(height))
+		if err != nil {
+			return err
+		}
+		hash, err = item.ValueCopy(nil)
+		return err
+	})
+	return hash, err
+}
+
+func (chain *Blockchain) IsMainChain(hash []byte) bool {
+	bi, err := chain.GetBlockIndex(hash)
+	if err != nil {
+		return false
+	}
+	mainHash, err := chain.GetMainHash(bi.Height)
+	return err == nil && bytes.Equal(mainHash, hash)
+}
+
+func (chain *Blockchain) GetBlockIndex(hash []byte) (*BlockIndex, error) {
+	var bi *BlockIndex
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		var err error
+		bi, err = getIndex(txn, hash)
+		return err
+	})
+	return bi, err
+}
+
+// setTip makes newTip the head of the main chain, disconnecting blocks back
+// to the fork point and connecting the new branch. If a block on the new
+// branch fails to connect the old chain is restored.
+func (chain *Blockchain) setTip(newTip []byte) error {
+	detach, attach, err := chain.findFork(chain.LastHash, newTip)
+	if err != nil {
+		return err
+	}
+	UTXO := UTXOSet{chain}
+	for _, b := range detach {
+		if err := UTXO.disconnectBlock(b); err != nil {
+			return err
+		}
+	}
+	for i, b := range attach {
+		err := UTXO.connectBlock(b)
+		if err == nil {
+			continue
+		}
+		chain.markInvalid(attach[i:])
+		for j := i - 1; j >= 0; j-- {
+			if err := UTXO.disconnectBlock(attach[j]); err != nil {
+				log.Panic(err)
+			}
+		}
+		for j := len(detach) - 1; j >= 0; j-- {
+			if err := UTXO.connectBlock(detach[j]); err != nil {
+				log.Panic(err)
+			}
+		}
+		return err
+	}
+	if len(detach) > 0 {
+		log.Printf("reorganized: disconnected %d blocks, connected %d", len(detach), len(attach))
+	}
+	return nil
+}
+
+// Disconnected returns the blocks from oldTip back to the main chain, tip
+// first. After a reorganization these are the blocks it disconnected.
+func (chain *Blockchain) Disconnected(oldTip []byte) ([]*Block, error) {
+	var blocks []*Block
+	for hash := oldTip; !chain.IsMainChain(hash); {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &block)
+		hash = block.PrevHash
+	}
+	return blocks, nil
+}
+
+// findFork returns the blocks to disconnect from oldTip (tip first) and the
+// blocks to connect up to newTip (parent first).
+func (chain *Blockchain) findFork(oldTip, newTip []byte) ([]*Block, []*Block, error) {
+	var detach, attach []*Block
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		oldIdx, err := getIndex(txn, oldTip)
+		if err != nil {
+			return err
+		}
+		newIdx, err := getIndex(txn, newTip)
+		if err != nil {
+			return err
+		}
+		for !bytes.Equal(oldIdx.Hash, newIdx.Hash) {
+			if oldIdx.Height >= newIdx.Height {
+				block, err := chain.GetBlock(oldIdx.Hash)
+				if err != nil {
+					return err
+				}
+				detach = append(detach, &block)
+				if oldIdx, err = getIndex(txn, oldIdx.PrevHash); err != nil {
+					return err
+				}
+			} else {
+				block, err := chain.GetBlock(newIdx.Hash)
+				if err != nil {
+					return err
+				}
+				attach = append([]*Block{&block}, attach...)
+				if newIdx, err = getIndex(txn, newIdx.PrevHash); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return detach, attach, err
+}
+
+func (chain *Blockchain) markInvalid(blocks []*Block) {
+	err := chain.Db.Update(func(txn *badger.Txn) error {
+		for _, b := range blocks {
+			bi, err := getIndex(txn, b.Hash)
+			if err != nil {
+				return err
+			}
+			bi.Invalid = true
+			if err := putIndex(txn, bi); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,164 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+	"zeechain/wallet"
+
+	"github.com/dgraph-io/badger"
+)
+
+// addBlock mines a block of txs on parent and adds it to the chain. The
+// block is returned even when AddBlock rejects it.
+func addBlock(t *testing.T, chain *Blockchain, parent []byte, txs ...*Transaction) (*Block, error) {
+	t.Helper()
+	bi, err := chain.GetBlockIndex(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.NextBits(bi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtp, err := chain.medianTime(bi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := CreateBlock(t.Context(), txs, parent, bi.Height+1, bits, mtp+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, chain.AddBlock(b)
+}
+
+// records returns every record stored under prefix.
+func records(t *testing.T, chain *Blockchain, prefix []byte) map[string]string {
+	t.Helper()
+	found := make(map[string]string)
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			found[string(it.Item().Key())] = string(val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+// indexes returns the UTXO set, transaction index and address index.
+func indexes(t *testing.T, chain *Blockchain) []map[string]string {
+	t.Helper()
+	return []map[string]string{
+		records(t, chain, utxoPrefix),
+		records(t, chain, txIndexPrefix),
+		records(t, chain, addrIndexPrefix),
+	}
+}
+
+// checkIndexes fails unless the indexes kept up to date block by block
+// match ones rebuilt from the main chain.
+func checkIndexes(t *testing.T, chain *Blockchain) {
+	t.Helper()
+	kept := indexes(t, chain)
+	UTXOSet{chain}.ReIndex()
+	chain.ReindexTransactions()
+	if err := chain.EnableAddressIndex(); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := indexes(t, chain)
+	for i, name := range []string{"UTXO set", "transaction index", "address index"} {
+		if !reflect.DeepEqual(kept[i], rebuilt[i]) {
+			t.Errorf("%s has %d records, rebuilt it has %d", name, len(kept[i]), len(rebuilt[i]))
+		}
+	}
+}
+
+func TestReorganize(t *testing.T) {
+	chain, w := newTestChain(t)
+	if err := chain.EnableAddressIndex(); err != nil {
+		t.Fatal(err)
+	}
+	other := wallet.NewWallet()
+	genesis := chain.LastHash
+	genesisBlock, err := chain.GetBlock(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesisBlock.Transactions[0].ID
+
+	spend := spendGenesis(t, chain, w, 4, 5)
+	a1, err := addBlock(t, chain, genesis, CoinBaseTx(string(w.Address()), "", 1, 0), spend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (UTXOSet{chain}).GetEntry(coinbase, 0) != nil {
+		t.Fatal("genesis output unspent after a1")
+	}
+
+	// a branch with more work takes over and the spend is rolled back
+	b1, err := addBlock(t, chain, genesis, CoinBaseTx(string(other.Address()), "", 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, a1.Hash) {
+		t.Fatal("switched to a branch with equal work")
+	}
+	b2, err := addBlock(t, chain, b1.Hash, CoinBaseTx(string(other.Address()), "", 2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, b2.Hash) {
+		t.Fatalf("tip is %x, want %x", chain.LastHash, b2.Hash)
+	}
+	if (UTXOSet{chain}).GetEntry(coinbase, 0) == nil {
+		t.Error("genesis output still spent after the reorganization")
+	}
+	if _, err := chain.GetTxLocation(spend.ID); err == nil {
+		t.Error("disconnected transaction still indexed")
+	}
+	if chain.IsMainChain(a1.Hash) || !chain.IsMainChain(b1.Hash) {
+		t.Error("main chain heights not moved to the new branch")
+	}
+	checkIndexes(t, chain)
+
+	// a longer branch with an invalid block leaves the chain as it was
+	before := indexes(t, chain)
+	a2, err := addBlock(t, chain, a1.Hash, CoinBaseTx(string(w.Address()), "", 2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := &Transaction{
+		Date:    time.Now(),
+		Inputs:  []TransInput{{ID: bytes.Repeat([]byte{1}, 32), OutId: 0}},
+		Outputs: []TransOutput{*NewTransOutput(1, string(w.Address()))},
+	}
+	missing.ID = missing.Hash()
+	a3, err := addBlock(t, chain, a2.Hash, CoinBaseTx(string(w.Address()), "", 3, 0), missing)
+	if !errors.Is(err, ErrMissingInput) {
+		t.Fatalf("err = %v, want %v", err, ErrMissingInput)
+	}
+	if !bytes.Equal(chain.LastHash, b2.Hash) {
+		t.Fatalf("tip is %x after a failed reorganization, want %x", chain.LastHash, b2.Hash)
+	}
+	if bi, err := chain.GetBlockIndex(a3.Hash); err != nil || !bi.Invalid {
+		t.Errorf("invalid block not marked: %+v, %v", bi, err)
+	}
+	if !reflect.DeepEqual(indexes(t, chain), before) {
+		t.Error("indexes changed by the failed reorganization")
+	}
+	if chain.IsMainChain(a2.Hash) || !chain.IsMainChain(b2.Hash) {
+		t.Error("main chain heights not restored")
+	}
+	checkIndexes(t, chain)
+}
@@ -19,7 +19,7 @@ func (chain *Blockchain) Iterator() *BlockChainIterator {
 func (iter *BlockChainIterator) Next() *Block {
 	var block *Block
 	err := iter.Db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
+		item, err := txn.Get(append(blockPrefix, iter.CurrentHash...))
 		if err != nil {
 			log.Panic(err)
 		}
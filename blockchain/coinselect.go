@@ -0,0 +1,257 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrNoExactMatch      = errors.New("no combination of coins matches the target")
+)
+
+// CoinSelector picks which of the spendable coins fund a payment of at
+// least target, fee included.
+type CoinSelector interface {
+	Select(coins []UTXOEntry, target uint64) ([]UTXOEntry, error)
+}
+
+// Outpoint names output Index of transaction ID.
+type Outpoint struct {
+	ID    []byte
+	Index int
+}
+
+func (o Outpoint) String() string {
+	return fmt.Sprintf("%x:%d", o.ID, o.Index)
+}
+
+// ParseOutpoint reads an outpoint written as TXID:INDEX.
+func ParseOutpoint(s string) (Outpoint, error) {
+	id, index, ok := strings.Cut(s, ":")
+	if !ok {
+		return Outpoint{}, fmt.Errorf("outpoint %q is not TXID:INDEX", s)
+	}
+	txId, err := hex.DecodeString(id)
+	if err != nil {
+		return Outpoint{}, fmt.Errorf("outpoint %q: %v", s, err)
+	}
+	n, err := strconv.Atoi(index)
+	if err != nil || n < 0 {
+		return Outpoint{}, fmt.Errorf("outpoint %q has a bad index", s)
+	}
+	return Outpoint{txId, n}, nil
+}
+
+// NewCoinSelector returns the selector called name: largest, bnb, random or
+// dust.
+func NewCoinSelector(name string) (CoinSelector, error) {
+	switch name {
+	case "", "largest":
+		return LargestFirst{}, nil
+	case "bnb":
+		return BranchAndBound{Fallback: LargestFirst{}}, nil
+	case "random":
+		return RandomSelect{}, nil
+	case "dust":
+		return ConsolidateDust{Threshold: DefaultDustThreshold}, nil
+	}
+	return nil, fmt.Errorf("unknown coin selection %q", name)
+}
+
+func totalValue(coins []UTXOEntry) uint64 {
+	var total uint64
+	for _, coin := range coins {
+		total += coin.Output.Value
+	}
+	return total
+}
+
+func insufficient(coins []UTXOEntry, target uint64) error {
+	return fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, totalValue(coins), target)
+}
+
+// accumulate takes coins in order until target is covered.
+func accumulate(coins []UTXOEntry, target uint64) ([]UTXOEntry, error) {
+	var picked []UTXOEntry
+	var total uint64
+	for _, coin := range coins {
+		if total >= target {
+			break
+		}
+		picked = append(picked, coin)
+		total += coin.Output.Value
+	}
+	if total < target {
+		return nil, insufficient(coins, target)
+	}
+	return picked, nil
+}
+
+func largestFirst(coins []UTXOEntry) []UTXOEntry {
+	sorted := slices.Clone(coins)
+	slices.SortStableFunc(sorted, func(a, b UTXOEntry) int {
+		switch {
+		case a.Output.Value > b.Output.Value:
+			return -1
+		case a.Output.Value < b.Output.Value:
+			return 1
+		}
+		return 0
+	})
+	return sorted
+}
+
+// LargestFirst spends the biggest coins, keeping the number of inputs low.
+type LargestFirst struct{}
+
+func (LargestFirst) Select(coins []UTXOEntry, target uint64) ([]UTXOEntry, error) {
+	return accumulate(largestFirst(coins), target)
+}
+
+// BranchAndBound searches for coins adding up to between target and target
+// plus Tolerance, so no change output is needed. Without such a set it
+// hands over to Fallback, or fails with ErrNoExactMatch.
+type BranchAndBound struct {
+	Tolerance uint64
+	// combinations tried before giving up, 100000 when zero
+	MaxTries int
+	Fallback CoinSelector
+}
+
+func (s BranchAndBound) Select(coins []UTXOEntry, target uint64) ([]UTXOEntry, error) {
+	if totalValue(coins) < target {
+		return nil, insufficient(coins, target)
+	}
+	maxTries := s.MaxTries
+	if maxTries == 0 {
+		maxTries = 100000
+	}
+	sorted := largestFirst(coins)
+	// left[i] is what the coins from i on add up to
+	left := make([]uint64, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		left[i] = left[i+1] + sorted[i].Output.Value
+	}
+	tries := 0
+	var picked []UTXOEntry
+	var search func(i int, total uint64) bool
+	search = func(i int, total uint64) bool {
+		tries++
+		if total >= target {
+			return total <= target+s.Tolerance
+		}
+		if i == len(sorted) || total+left[i] < target || tries > maxTries {
+			return false
+		}
+		picked = append(picked, sorted[i])
+		if search(i+1, total+sorted[i].Output.Value) {
+			return true
+		}
+		picked = picked[:len(picked)-1]
+		return search(i+1, total)
+	}
+	if search(0, 0) {
+		return picked, nil
+	}
+	if s.Fallback != nil {
+		return s.Fallback.Select(coins, target)
+	}
+	return nil, ErrNoExactMatch
+}
+
+// RandomSelect spends coins in random order, so the inputs of a payment say
+// less about which coins belong together.
+type RandomSelect struct{}
+
+func (RandomSelect) Select(coins []UTXOEntry, target uint64) ([]UTXOEntry, error) {
+	shuffled := slices.Clone(coins)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return accumulate(shuffled, target)
+}
+
+// DefaultDustThreshold is the value below which ConsolidateDust sweeps coins
+// up when the name "dust" is used.
+const DefaultDustThreshold = 2
+
+// ConsolidateDust spends every coin worth less than Threshold along with the
+// payment, topped up with the largest coins, to shrink the wallet's UTXOs.
+type ConsolidateDust struct {
+	Threshold uint64
+}
+
+func (s ConsolidateDust) Select(coins []UTXOEntry, target uint64) ([]UTXOEntry, error) {
+	var dust, rest []UTXOEntry
+	for _, coin := range coins {
+		if coin.Output.Value < s.Threshold {
+			dust = append(dust, coin)
+		} else {
+			rest = append(rest, coin)
+		}
+	}
+	total := totalValue(dust)
+	if total >= target {
+		return dust, nil
+	}
+	more, err := accumulate(largestFirst(rest), target-total)
+	if err != nil {
+		return nil, insufficient(coins, target)
+	}
+	return append(dust, more...), nil
+}
+
+// SkipSpent leaves out the coins Spent reports, such as those already spent
+// by unconfirmed transactions, and lets Selector choose from the rest.
+type SkipSpent struct {
+	Selector CoinSelector
+	Spent    func(Outpoint) bool
+}
+
+func (s SkipSpent) Select(coins []UTXOEntry, target uint64) ([]UTXOEntry, error) {
+	var unspent []UTXOEntry
+	for _, coin := range coins {
+		if !s.Spent(Outpoint{coin.TxID, coin.Index}) {
+			unspent = append(unspent, coin)
+		}
+	}
+	selector := s.Selector
+	if selector == nil {
+		selector = LargestFirst{}
+	}
+	return selector.Select(unspent, target)
+}
+
+// ManualSelect spends exactly the given outpoints, which must be among the
+// spendable coins and cover the target.
+type ManualSelect struct {
+	Outpoints []Outpoint
+}
+
+func (s ManualSelect) Select(coins []UTXOEntry, target uint64) ([]UTXOEntry, error) {
+	var picked []UTXOEntry
+	for _, o := range s.Outpoints {
+		i := slices.IndexFunc(coins, func(coin UTXOEntry) bool {
+			return coin.Index == o.Index && string(coin.TxID) == string(o.ID)
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("%s is not among the spendable coins", o)
+		}
+		if slices.ContainsFunc(picked, func(coin UTXOEntry) bool {
+			return coin.Index == o.Index && string(coin.TxID) == string(o.ID)
+		}) {
+			return nil, fmt.Errorf("%s is listed twice", o)
+		}
+		picked = append(picked, coins[i])
+	}
+	if totalValue(picked) < target {
+		return nil, insufficient(picked, target)
+	}
+	return picked, nil
+}
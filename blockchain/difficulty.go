@@ -0,0 +1,88 @@
+package blockchain
+
+import (
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+// CompactToBig expands the compact representation of a target stored in
+// Block.Bits: the high byte is a base 256 exponent, the low three bytes
+// the mantissa.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+	var n *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		n = big.NewInt(int64(mantissa))
+	} else {
+		n = big.NewInt(int64(mantissa))
+		n.Lsh(n, 8*(exponent-3))
+	}
+	if compact&0x00800000 != 0 {
+		n.Neg(n)
+	}
+	return n
+}
+
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(n).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Uint64())
+	}
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// NextBits returns the target a block built on parent must use. Every
+// RetargetInterval blocks the target is scaled by how long the last interval
+// took compared to TargetSpacing, by at most a factor of four.
+func (chain *Blockchain) NextBits(parent *BlockIndex) (uint32, error) {
+	if (parent.Height+1)%RetargetInterval != 0 {
+		return parent.Bits, nil
+	}
+	first := parent
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		for first.Height > parent.Height+1-RetargetInterval {
+			var err error
+			if first, err = getIndex(txn, first.PrevHash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	expected := int64(TargetSpacing * RetargetInterval)
+	actual := parent.TimeStamp - first.TimeStamp
+	if actual < expected/4 {
+		actual = expected / 4
+	}
+	if actual > expected*4 {
+		actual = expected * 4
+	}
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(powLimit) > 0 {
+		target.Set(powLimit)
+	}
+	return BigToCompact(target), nil
+}
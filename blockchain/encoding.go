@@ -0,0 +1,162 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// SerializeVersion is the first byte of every serialized block, header,
+// transaction and UTXO entry. Integers are big endian and fixed width, byte
+// strings and lists are prefixed with a uint32 length.
+const SerializeVersion = 1
+
+// maxFieldLength bounds a single length prefix so corrupt data cannot make
+// the decoder allocate without limit.
+const maxFieldLength = 32 << 20
+
+var ErrBadEncoding = errors.New("malformed serialized data")
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func newEncoder() *encoder {
+	e := &encoder{}
+	e.buf.WriteByte(SerializeVersion)
+	return e
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf.WriteByte(v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.buf.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.uint64(uint64(v))
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// decoder reads what encoder wrote. The first error sticks, later reads
+// return zero values, so callers check err once at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func newDecoder(data []byte) *decoder {
+	d := &decoder{data: data}
+	if v := d.uint8(); d.err == nil && v != SerializeVersion {
+		d.err = fmt.Errorf("%w: unknown version %d", ErrBadEncoding, v)
+	}
+	return d
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.err = fmt.Errorf("%w: unexpected end of data", ErrBadEncoding)
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) bool() bool {
+	switch d.uint8() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: bad boolean", ErrBadEncoding)
+	}
+	return false
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) int64() int64 {
+	return int64(d.uint64())
+}
+
+// length reads a list or byte string length prefix.
+func (d *decoder) length() int {
+	n := d.uint32()
+	if n > maxFieldLength || int(n) > len(d.data) {
+		if d.err == nil {
+			d.err = fmt.Errorf("%w: length %d out of range", ErrBadEncoding, n)
+		}
+		return 0
+	}
+	return int(n)
+}
+
+// bytes returns a copy so the result does not alias the input buffer, which
+// badger reuses once Value returns. An empty string decodes as nil.
+func (d *decoder) bytes() []byte {
+	n := d.length()
+	b := d.next(n)
+	if len(b) == 0 {
+		return nil
+	}
+	return bytes.Clone(b)
+}
+
+// finish reports the first error, or trailing data after a complete value.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf("%w: %d trailing bytes", ErrBadEncoding, len(d.data))
+	}
+	return d.err
+}
@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func goldenHeader() BlockHeader {
+	return BlockHeader{
+		Version:    1,
+		PrevHash:   []byte{0xaa, 0xbb},
+		MerkleRoot: []byte{0xcc, 0xdd},
+		TimeStamp:  1600000000,
+		Bits:       0x1f00ffff,
+		Nonce:      42,
+		Height:     7,
+	}
+}
+
+func goldenTransaction() *Transaction {
+	return &Transaction{
+		Date:     time.Unix(0, 1600000000000000005),
+		ID:       []byte{0x01, 0x02},
+		Inputs:   []TransInput{{ID: []byte{0x03, 0x04}, OutId: 1, ScriptSig: []byte{0x05}, Sequence: 0xffffffff}},
+		Outputs:  []TransOutput{{Value: 10, ScriptPubKey: []byte{0x6a}}},
+		LockTime: 0,
+	}
+}
+
+// the encodings below are written out field by field, without the leading
+// version byte
+const (
+	headerBody = "0000000000000001" + // Version
+		"00000002aabb" + // PrevHash
+		"00000002ccdd" + // MerkleRoot
+		"000000005f5e1000" + // TimeStamp
+		"1f00ffff" + // Bits
+		"000000000000002a" + // Nonce
+		"0000000000000007" // Height
+
+	transactionBody = "16345785d8a00005" + // Date in nanoseconds
+		"000000020102" + // ID
+		"00000001" + // one input
+		"000000020304" + "0000000000000001" + "0000000105" + "ffffffff" +
+		"00000001" + // one output
+		"000000000000000a" + "000000016a" +
+		"0000000000000000" // LockTime
+
+	blockBody = headerBody +
+		"00000002eeff" + // Hash
+		"00000001" + // one transaction
+		transactionBody
+)
+
+func golden(t *testing.T, body string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString("01" + body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncodingGolden(t *testing.T) {
+	h := goldenHeader()
+	tx := goldenTransaction()
+	block := &Block{BlockHeader: h, Hash: []byte{0xee, 0xff}, Transactions: []*Transaction{tx}}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		body   string
+		decode func([]byte) (any, error)
+		want   any
+	}{
+		{"header", h.Serialize(), headerBody, func(b []byte) (any, error) { return DecodeHeader(b) }, &h},
+		{"transaction", tx.Serialize(), transactionBody, func(b []byte) (any, error) { return DecodeTransaction(b) }, tx},
+		{"block", block.Serialize(), blockBody, func(b []byte) (any, error) { return DecodeBlock(b) }, block},
+	}
+	for _, test := range tests {
+		want := golden(t, test.body)
+		if !bytes.Equal(test.data, want) {
+			t.Errorf("%s encodes as\n%x\nwant\n%x", test.name, test.data, want)
+		}
+		got, err := test.decode(want)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s decodes as %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	decoders := map[string]struct {
+		body   string
+		decode func([]byte) error
+	}{
+		"header":      {headerBody, func(b []byte) error { _, err := DecodeHeader(b); return err }},
+		"transaction": {transactionBody, func(b []byte) error { _, err := DecodeTransaction(b); return err }},
+		"block":       {blockBody, func(b []byte) error { _, err := DecodeBlock(b); return err }},
+	}
+	for name, dec := range decoders {
+		data := golden(t, dec.body)
+		for n := range len(data) {
+			if err := dec.decode(data[:n]); !errors.Is(err, ErrBadEncoding) {
+				t.Errorf("%s truncated to %d bytes: err = %v, want %v", name, n, err, ErrBadEncoding)
+			}
+		}
+		if err := dec.decode(append(bytes.Clone(data), 0)); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("%s with a trailing byte: err = %v, want %v", name, err, ErrBadEncoding)
+		}
+		unknown := bytes.Clone(data)
+		unknown[0] = SerializeVersion + 1
+		if err := dec.decode(unknown); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("%s with version %d: err = %v, want %v", name, unknown[0], err, ErrBadEncoding)
+		}
+	}
+}
+
+func TestDecodeRejectsHugeLength(t *testing.T) {
+	// the header's PrevHash claims far more bytes than follow
+	data := golden(t, "0000000000000001"+"7fffffff"+strings.Repeat("00", 8))
+	if _, err := DecodeHeader(data); !errors.Is(err, ErrBadEncoding) {
+		t.Errorf("err = %v, want %v", err, ErrBadEncoding)
+	}
+}
+
+func TestDecodeRejectsBadBool(t *testing.T) {
+	bi := &BlockIndex{Hash: []byte{1}, Height: 3, Work: []byte{2}}
+	data := bi.Serialize()
+	data[len(data)-1] = 2
+	if _, err := DecodeBlockIndex(data); !errors.Is(err, ErrBadEncoding) {
+		t.Errorf("err = %v, want %v", err, ErrBadEncoding)
+	}
+}
+
+func TestRecordsRoundTrip(t *testing.T) {
+	bi := &BlockIndex{Hash: []byte{1}, PrevHash: []byte{2}, Height: 3, TimeStamp: 4, Bits: 5, Work: []byte{6}, Invalid: true}
+	gotIndex, err := DecodeBlockIndex(bi.Serialize())
+	if err != nil || !reflect.DeepEqual(gotIndex, bi) {
+		t.Errorf("block index decodes as %+v, %v; want %+v", gotIndex, err, bi)
+	}
+	undo := &BlockUndo{Spent: []UTXOEntry{
+		{TxID: []byte{1}, Index: 2, Output: TransOutput{Value: 3, ScriptPubKey: []byte{4}}, Height: 5, Coinbase: true},
+		{TxID: []byte{6}, Index: 0, Output: TransOutput{Value: 7, ScriptPubKey: []byte{8}}, Height: 9},
+	}}
+	gotUndo, err := DecodeBlockUndo(undo.Serialize())
+	if err != nil || !reflect.DeepEqual(gotUndo, undo) {
+		t.Errorf("block undo decodes as %+v, %v; want %+v", gotUndo, err, undo)
+	}
+}
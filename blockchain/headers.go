@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"log"
+
+	"github.com/dgraph-io/badger"
+)
+
+// MaxHeaders is the most headers sent in reply to a single locator.
+const MaxHeaders = 2000
+
+var headerPrefix = []byte("hdr-")
+
+func (chain *Blockchain) GetBlockHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(headerPrefix, hash...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			header = DeserializeHeader(val)
+			return nil
+		})
+	})
+	return header, err
+}
+
+// AddHeader validates a header and indexes it without its transactions, so
+// the body can be fetched later.
+func (chain *Blockchain) AddHeader(h *BlockHeader) error {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+	hash := h.Hash()
+	if _, err := chain.GetBlockIndex(hash); err == nil {
+		return nil
+	}
+	if err := chain.ValidateHeader(h, hash); err != nil {
+		return err
+	}
+	return chain.Db.Update(func(txn *badger.Txn) error {
+		parent, err := getIndex(txn, h.PrevHash)
+		if err != nil {
+			return err
+		}
+		bi := newBlockIndex(h, hash, parent)
+		bi.HeaderOnly = true
+		if err := txn.Set(append(headerPrefix, hash...), h.Serialize()); err != nil {
+			return err
+		}
+		return putIndex(txn, bi)
+	})
+}
+
+// Locator lists main chain hashes from the tip back to genesis, dense near
+// the tip and exponentially sparser further back, so a peer can find where
+// our chains diverge.
+func (chain *Blockchain) Locator() [][]byte {
+	var locator [][]byte
+	step := 1
+	for height := chain.GetBestHeight(); height > 0; height -= step {
+		hash, err := chain.GetMainHash(height)
+		if err != nil {
+			log.Panic(err)
+		}
+		locator = append(locator, hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	genesis, err := chain.GetMainHash(0)
+	if err != nil {
+		log.Panic(err)
+	}
+	return append(locator, genesis)
+}
+
+// HeadersAfter returns up to max main chain headers following the first
+// locator hash that is on our main chain.
+func (chain *Blockchain) HeadersAfter(locator [][]byte, max int) []BlockHeader {
+	start := 0
+	for _, hash := range locator {
+		if chain.IsMainChain(hash) {
+			bi, err := chain.GetBlockIndex(hash)
+			if err != nil {
+				log.Panic(err)
+			}
+			start = bi.Height + 1
+			break
+		}
+	}
+	var headers []BlockHeader
+	best := chain.GetBestHeight()
+	for height := start; height <= best && len(headers) < max; height++ {
+		hash, err := chain.GetMainHash(height)
+		if err != nil {
+			log.Panic(err)
+		}
+		header, err := chain.GetBlockHeader(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		headers = append(headers, *header)
+	}
+	return headers
+}
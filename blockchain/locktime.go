@@ -0,0 +1,133 @@
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A relative lock is kept in the low bits of an input's Sequence. It counts
+// blocks, or units of 512 seconds when SequenceLockSeconds is set, from the
+// block that created the spent output. A zero Sequence means no lock.
+const (
+	SequenceLockSeconds = 1 << 22
+	SequenceLockMask    = 0xffff
+	// seconds are stored shifted right by this much
+	sequenceGranularity = 9
+	// longest relative lock in seconds
+	MaxRelativeLockSeconds = SequenceLockMask << sequenceGranularity
+)
+
+// LockTimeIsHeight reports whether a lock time is a block height rather than
+// a unix time.
+func LockTimeIsHeight(lockTime int64) bool {
+	return lockTime < LockTimeThreshold
+}
+
+// RelativeLock returns the sequence locking a spent output for the given
+// number of blocks.
+func RelativeLock(blocks int) uint32 {
+	return uint32(blocks) & SequenceLockMask
+}
+
+// RelativeTimeLock returns the sequence locking a spent output for at least
+// the given number of seconds, rounded up to the next 512.
+func RelativeTimeLock(seconds int64) uint32 {
+	units := (seconds + 1<<sequenceGranularity - 1) >> sequenceGranularity
+	return SequenceLockSeconds | uint32(units)&SequenceLockMask
+}
+
+// IsFinal reports whether tx may be mined in a block at height whose parent
+// has median time past mtp. LockTime is the first height or time the
+// transaction is valid, zero means no lock.
+func (tx *Transaction) IsFinal(height int, mtp int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	if LockTimeIsHeight(tx.LockTime) {
+		return int64(height) >= tx.LockTime
+	}
+	return mtp >= tx.LockTime
+}
+
+// MedianTimePast is the median timestamp of the main chain block at height
+// and the ones before it, up to MedianTimeSpan of them. A block must be
+// timestamped after the median time past of its parent, so unlike a single
+// timestamp it never goes backwards and time locks are measured against it.
+func (chain *Blockchain) MedianTimePast(height int) (int64, error) {
+	if height < 0 {
+		return 0, nil
+	}
+	hash, err := chain.GetMainHash(height)
+	if err != nil {
+		return 0, err
+	}
+	bi, err := chain.GetBlockIndex(hash)
+	if err != nil {
+		return 0, err
+	}
+	return chain.medianTime(bi)
+}
+
+// medianTime is the median time past of bi, following its own ancestors so
+// it works for blocks off the main chain.
+func (chain *Blockchain) medianTime(bi *BlockIndex) (int64, error) {
+	var times []int64
+	for {
+		times = append(times, bi.TimeStamp)
+		if len(times) == MedianTimeSpan || len(bi.PrevHash) == 0 {
+			break
+		}
+		var err error
+		if bi, err = chain.GetBlockIndex(bi.PrevHash); err != nil {
+			return 0, err
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2], nil
+}
+
+// checkLocks checks the lock time of tx and the relative lock of each input
+// for a block at height. confirmed holds the height of the block that
+// created each input's output, outputs not yet in a block count as created
+// at height.
+func (chain *Blockchain) checkLocks(tx *Transaction, height int, confirmed []int) error {
+	mtp, err := chain.MedianTimePast(height - 1)
+	if err != nil {
+		return err
+	}
+	if !tx.IsFinal(height, mtp) {
+		return txError(tx.ID, ErrTimeLocked, "until %d", tx.LockTime)
+	}
+	for inIdx, in := range tx.Inputs {
+		value := int64(in.Sequence & SequenceLockMask)
+		if value == 0 {
+			continue
+		}
+		if in.Sequence&SequenceLockSeconds == 0 {
+			if int64(height) < int64(confirmed[inIdx])+value {
+				return txError(tx.ID, ErrTimeLocked, "input %d until height %d", inIdx, int64(confirmed[inIdx])+value)
+			}
+			continue
+		}
+		start, err := chain.MedianTimePast(max(confirmed[inIdx]-1, 0))
+		if err != nil {
+			return err
+		}
+		if until := start + value<<sequenceGranularity; mtp < until {
+			return txError(tx.ID, ErrTimeLocked, "input %d until time %d", inIdx, until)
+		}
+	}
+	return nil
+}
+
+// sequenceString describes the relative lock of an input for String.
+func sequenceString(seq uint32) string {
+	value := seq & SequenceLockMask
+	if value == 0 {
+		return "none"
+	}
+	if seq&SequenceLockSeconds != 0 {
+		return fmt.Sprintf("%d seconds", value<<sequenceGranularity)
+	}
+	return fmt.Sprintf("%d blocks", value)
+}
@@ -0,0 +1,35 @@
+package blockchain
+
+import "math/big"
+
+// consensus parameters, every node on the network must agree on these
+const (
+	// blocks between difficulty adjustments
+	RetargetInterval = 10
+	// seconds we aim to spend mining each block
+	TargetSpacing = 10
+	// how far ahead of our clock a block timestamp may be, in seconds
+	MaxFutureBlockTime = 2 * 60 * 60
+
+	// coinbase reward of the first blocks, halved every HalvingInterval
+	InitialSubsidy  = 10
+	HalvingInterval = 1000
+	// no more coins are created once this many have been issued
+	MaxSupply = 18000
+	// blocks a coinbase output must be buried under before it can be spent
+	CoinbaseMaturity = 10
+
+	// largest serialized block and most transactions, coinbase included
+	MaxBlockSize         = 1 << 20
+	MaxBlockTransactions = 4000
+
+	// lock times below this are block heights, the rest unix times
+	LockTimeThreshold = 500000000
+	// blocks whose timestamps make up the median time past
+	MedianTimeSpan = 11
+)
+
+// powLimit is the easiest target a block may use.
+var powLimit = new(big.Int).Lsh(big.NewInt(1), 256-12)
+
+var InitialBits = BigToCompact(powLimit)
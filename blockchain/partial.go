@@ -0,0 +1,258 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"time"
+	"zeechain/wallet"
+)
+
+var ErrNotEnoughSignatures = errors.New("not enough signatures")
+
+// PartialTx is a transaction travelling between the machine that built it
+// and the ones holding its keys. It carries the outputs being spent so it
+// can be checked and signed without a copy of the chain.
+type PartialTx struct {
+	Tx     *Transaction
+	Inputs []PartialInput
+}
+
+// PartialInput describes the output an input spends. Pay to public key
+// hash inputs get their ScriptSig once signed. Multisig inputs carry the
+// redeem script and a signature slot for every key of it, empty until that
+// key signs.
+type PartialInput struct {
+	PrevOut      TransOutput
+	ScriptSig    []byte
+	RedeemScript []byte
+	Signatures   [][]byte
+}
+
+// CreatePartialTx pays amount to the address from outputs sent to from,
+// leaving fee for the miner and returning the change to from. Spending from
+// a multisig address needs its redeem script. The selector picks the outputs
+// to spend, LargestFirst when nil. The transaction is not signed.
+func CreatePartialTx(from, to string, redeem []byte, amount, fee int, UTXO *UTXOSet, selector CoinSelector) (*PartialTx, error) {
+	lock := AddressScript([]byte(from))
+	var keys [][]byte
+	if hash := ExtractScriptHash(lock); hash != nil {
+		if !bytes.Equal(hash, wallet.PublicKeyHash(redeem)) {
+			return nil, errors.New("redeem script does not match the address")
+		}
+		var err error
+		if _, keys, err = ParseMultisig(redeem); err != nil {
+			return nil, err
+		}
+	}
+	coins, acc, err := UTXO.SelectCoins(lock, uint64(amount+fee), selector)
+	if err != nil {
+		return nil, err
+	}
+	ptx := &PartialTx{Tx: &Transaction{Date: time.Now(), Inputs: coinInputs(coins)}}
+	for _, coin := range coins {
+		in := PartialInput{PrevOut: coin.Output}
+		if keys != nil {
+			in.RedeemScript = redeem
+			in.Signatures = make([][]byte, len(keys))
+		}
+		ptx.Inputs = append(ptx.Inputs, in)
+	}
+	ptx.Tx.Outputs = append(ptx.Tx.Outputs, *NewTransOutput(uint64(amount), to))
+	if acc > uint64(amount+fee) {
+		ptx.Tx.Outputs = append(ptx.Tx.Outputs, TransOutput{acc - uint64(amount+fee), lock})
+	}
+	ptx.Tx.ID = ptx.Tx.Hash()
+	return ptx, nil
+}
+
+// SetLocks sets the lock time of the transaction and the relative lock of
+// every input. Signatures cover both, so it must be done before signing.
+func (p *PartialTx) SetLocks(lockTime int64, sequence uint32) error {
+	for inIdx, in := range p.Inputs {
+		signed := len(in.ScriptSig) > 0
+		for _, sig := range in.Signatures {
+			signed = signed || len(sig) > 0
+		}
+		if signed {
+			return fmt.Errorf("input %d is already signed", inIdx)
+		}
+	}
+	p.Tx.LockTime = lockTime
+	for i := range p.Tx.Inputs {
+		p.Tx.Inputs[i].Sequence = sequence
+	}
+	p.Tx.ID = p.Tx.Hash()
+	return nil
+}
+
+// Fee is what the spent outputs are worth beyond the transaction's outputs.
+func (p *PartialTx) Fee() (uint64, error) {
+	var in, out uint64
+	var ok bool
+	for _, pin := range p.Inputs {
+		if in, ok = addValue(in, pin.PrevOut.Value); !ok {
+			return 0, ErrBadTransaction
+		}
+	}
+	for _, o := range p.Tx.Outputs {
+		if out, ok = addValue(out, o.Value); !ok {
+			return 0, ErrBadTransaction
+		}
+	}
+	if out > in {
+		return 0, ErrBadTransaction
+	}
+	return in - out, nil
+}
+
+// Sign adds privKey's signature to every input it can unlock, alone or as
+// one of the keys of a multisig, and returns how many inputs it signed. The
+// signatures commit to what hashType covers.
+func (p *PartialTx) Sign(privKey ecdsa.PrivateKey, hashType SigHashType) (int, error) {
+	pubKey := wallet.PublicKeyBytes(&privKey.PublicKey)
+	values := make([]uint64, len(p.Inputs))
+	for inIdx, in := range p.Inputs {
+		values[inIdx] = in.PrevOut.Value
+	}
+	signed := 0
+	for inIdx, in := range p.Inputs {
+		prevScript := in.PrevOut.ScriptPubKey
+		if hash := ExtractPubKeyHash(prevScript); hash != nil {
+			if !bytes.Equal(hash, wallet.PublicKeyHash(pubKey)) {
+				continue
+			}
+			sig, err := p.Tx.signInput(inIdx, &privKey, prevScript, values, hashType)
+			if err != nil {
+				return signed, err
+			}
+			p.Inputs[inIdx].ScriptSig = PubKeyHashSig(sig, pubKey)
+			signed++
+			continue
+		}
+		if in.RedeemScript == nil {
+			continue
+		}
+		_, keys, err := ParseMultisig(in.RedeemScript)
+		if err != nil {
+			return signed, err
+		}
+		if len(in.Signatures) != len(keys) {
+			return signed, fmt.Errorf("input %d has %d signature slots for %d keys", inIdx, len(in.Signatures), len(keys))
+		}
+		for k, key := range keys {
+			if !bytes.Equal(key, pubKey) {
+				continue
+			}
+			sig, err := p.Tx.signInput(inIdx, &privKey, in.RedeemScript, values, hashType)
+			if err != nil {
+				return signed, err
+			}
+			in.Signatures[k] = sig
+			signed++
+		}
+	}
+	if signed == 0 {
+		return 0, errors.New("key cannot sign any input")
+	}
+	return signed, nil
+}
+
+// Signed returns how many inputs are ready and how many there are.
+func (p *PartialTx) Signed() (int, int) {
+	ready := 0
+	for i := range p.Inputs {
+		if _, err := p.unlock(i); err == nil {
+			ready++
+		}
+	}
+	return ready, len(p.Inputs)
+}
+
+// unlock builds the unlocking script of input inIdx from what has been
+// collected so far.
+func (p *PartialTx) unlock(inIdx int) ([]byte, error) {
+	in := p.Inputs[inIdx]
+	if in.RedeemScript == nil {
+		if len(in.ScriptSig) == 0 {
+			return nil, fmt.Errorf("%w: input %d is not signed", ErrNotEnoughSignatures, inIdx)
+		}
+		return in.ScriptSig, nil
+	}
+	m, _, err := ParseMultisig(in.RedeemScript)
+	if err != nil {
+		return nil, err
+	}
+	var script []byte
+	n := 0
+	for _, sig := range in.Signatures {
+		if len(sig) > 0 && n < m {
+			script = ScriptPush(script, sig)
+			n++
+		}
+	}
+	if n < m {
+		return nil, fmt.Errorf("%w: input %d has %d of %d", ErrNotEnoughSignatures, inIdx, n, m)
+	}
+	return ScriptPush(script, in.RedeemScript), nil
+}
+
+// Finalize builds the unlocking scripts once every input is signed and
+// returns the transaction ready to broadcast.
+func (p *PartialTx) Finalize() (*Transaction, error) {
+	tx := *p.Tx
+	tx.Inputs = append([]TransInput{}, p.Tx.Inputs...)
+	for inIdx := range p.Inputs {
+		script, err := p.unlock(inIdx)
+		if err != nil {
+			return nil, err
+		}
+		tx.Inputs[inIdx].ScriptSig = script
+	}
+	return &tx, nil
+}
+
+func (p *PartialTx) Serialize() []byte {
+	e := newEncoder()
+	p.Tx.encode(e)
+	e.uint32(uint32(len(p.Inputs)))
+	for _, in := range p.Inputs {
+		in.PrevOut.encode(e)
+		e.bytes(in.ScriptSig)
+		e.bytes(in.RedeemScript)
+		e.uint32(uint32(len(in.Signatures)))
+		for _, sig := range in.Signatures {
+			e.bytes(sig)
+		}
+	}
+	return e.Bytes()
+}
+
+func DeserializePartialTx(data []byte) (*PartialTx, error) {
+	p := &PartialTx{Tx: &Transaction{}}
+	d := newDecoder(data)
+	p.Tx.decode(d)
+	n := d.length()
+	for i := 0; i < n && d.err == nil; i++ {
+		var in PartialInput
+		in.PrevOut.decode(d)
+		in.ScriptSig = d.bytes()
+		in.RedeemScript = d.bytes()
+		sigs := d.length()
+		for j := 0; j < sigs && d.err == nil; j++ {
+			in.Signatures = append(in.Signatures, d.bytes())
+		}
+		p.Inputs = append(p.Inputs, in)
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	if len(p.Inputs) != len(p.Tx.Inputs) {
+		return nil, fmt.Errorf("%w: %d inputs, %d partial inputs", ErrBadEncoding, len(p.Tx.Inputs), len(p.Inputs))
+	}
+	if !bytes.Equal(p.Tx.ID, p.Tx.Hash()) {
+		return nil, fmt.Errorf("%w: transaction ID does not match", ErrBadEncoding)
+	}
+	return p, nil
+}
@@ -2,19 +2,29 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const difficulty = 12
+// MaxNonce bounds the nonces tried for one header. Once they are used up the
+// timestamp or the coinbase extra nonce is changed and the search restarts.
+const MaxNonce = math.MaxUint32
+
+var ErrNonceExhausted = errors.New("nonce space exhausted")
 
 type ProofOfWork struct {
-	Block  *Block
-	Target *big.Int
+	Header   *BlockHeader
+	Target   *big.Int
+	HashRate float64
 }
 
 func ToHex(num int64) []byte {
@@ -26,47 +36,85 @@ func ToHex(num int64) []byte {
 	return buf.Bytes()
 }
 
-func NewProof(block *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target = target.Lsh(target, uint(256-difficulty))
-	return &ProofOfWork{block, target}
+func NewProof(header *BlockHeader) *ProofOfWork {
+	return &ProofOfWork{Header: header, Target: CompactToBig(header.Bits)}
 }
 
+// InitData is the canonical encoding of the header with the given nonce,
+// which is what the block hash is taken over.
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)),
-			ToHex(int64(difficulty)),
-		}, []byte{})
-	return data
+	h := *pow.Header
+	h.Nonce = nonce
+	return h.Serialize()
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
-	nonce := 0
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
-		fmt.Printf("mining: %x\n", hash)
-		intHash.SetBytes(hash[:])
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
-		}
+// Run searches the nonce space on every CPU until a hash below the target is
+// found, ctx is cancelled or every nonce up to MaxNonce has been tried.
+func (pow *ProofOfWork) Run(ctx context.Context) (int, []byte, error) {
+	stop, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type solution struct {
+		nonce int
+		hash  []byte
+	}
+	found := make(chan solution, 1)
+	var hashes atomic.Int64
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(nonce int) {
+			defer wg.Done()
+			var intHash big.Int
+			for i := 0; nonce <= MaxNonce; i, nonce = i+1, nonce+workers {
+				if i%1024 == 0 && stop.Err() != nil {
+					return
+				}
+				hash := sha256.Sum256(pow.InitData(nonce))
+				hashes.Add(1)
+				intHash.SetBytes(hash[:])
+				if intHash.Cmp(pow.Target) == -1 {
+					select {
+					case found <- solution{nonce, hash[:]}:
+						cancel()
+					default:
+					}
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		pow.HashRate = float64(hashes.Load()) / elapsed
+	}
+	select {
+	case s := <-found:
+		log.Printf("mined %x after %d hashes, %.0f H/s on %d workers", s.hash, hashes.Load(), pow.HashRate, workers)
+		return s.nonce, s.hash, nil
+	default:
 	}
-	fmt.Println()
-	return nonce, hash[:]
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	return 0, nil, ErrNonceExhausted
 }
 
 func (pow *ProofOfWork) Validate() bool {
+	if pow.Target.Sign() <= 0 || pow.Target.Cmp(powLimit) > 0 {
+		return false
+	}
 	var intHash big.Int
-	data := pow.InitData(int(pow.Block.Nonce))
+	data := pow.InitData(pow.Header.Nonce)
 	hash := sha256.Sum256(data)
 	intHash.SetBytes(hash[:])
 
 	return intHash.Cmp(pow.Target) == -1
 }
+
+// Work is the expected number of hashes needed to meet the target.
+func (pow *ProofOfWork) Work() *big.Int {
+	denom := new(big.Int).Add(pow.Target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denom)
+}
@@ -0,0 +1,607 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"zeechain/wallet"
+)
+
+// Opcodes share their values with Bitcoin script so scripts are easy to read
+// for anyone who knows it. 0x01-0x4b push that many bytes.
+const (
+	OP_0                   = 0x00
+	OP_PUSHDATA1           = 0x4c
+	OP_PUSHDATA2           = 0x4d
+	OP_1                   = 0x51
+	OP_16                  = 0x60
+	OP_VERIFY              = 0x69
+	OP_RETURN              = 0x6a
+	OP_DROP                = 0x75
+	OP_DUP                 = 0x76
+	OP_EQUAL               = 0x87
+	OP_EQUALVERIFY         = 0x88
+	OP_HASH160             = 0xa9
+	OP_CHECKSIG            = 0xac
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+const (
+	MaxScriptSize   = 10000
+	MaxStackSize    = 1000
+	MaxMultisigKeys = 20
+	// largest payload of a data output
+	MaxDataSize = 80
+	// script numbers are at most this many bytes, enough for a block height
+	// or a unix time
+	maxNumSize = 5
+)
+
+var opNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_HASH160:             "OP_HASH160",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+var (
+	ErrBadScript    = errors.New("malformed script")
+	ErrScriptFailed = errors.New("script evaluated to false")
+)
+
+type scriptOp struct {
+	code byte
+	data []byte
+}
+
+func (op scriptOp) isPush() bool {
+	return op.code <= OP_PUSHDATA2 || (op.code >= OP_1 && op.code <= OP_16)
+}
+
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > MaxScriptSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrBadScript, len(script))
+	}
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		code := script[i]
+		i++
+		n := 0
+		switch {
+		case code > OP_0 && code < OP_PUSHDATA1:
+			n = int(code)
+		case code == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, fmt.Errorf("%w: truncated push", ErrBadScript)
+			}
+			n = int(script[i])
+			i++
+		case code == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, fmt.Errorf("%w: truncated push", ErrBadScript)
+			}
+			n = int(binary.BigEndian.Uint16(script[i:]))
+			i += 2
+		}
+		if i+n > len(script) {
+			return nil, fmt.Errorf("%w: truncated push", ErrBadScript)
+		}
+		ops = append(ops, scriptOp{code, script[i : i+n]})
+		i += n
+	}
+	return ops, nil
+}
+
+// ScriptPush appends the shortest push of data to script.
+func ScriptPush(script, data []byte) []byte {
+	switch n := len(data); {
+	case n < OP_PUSHDATA1:
+		script = append(script, byte(n))
+	case n <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(n))
+	default:
+		script = append(script, OP_PUSHDATA2)
+		script = binary.BigEndian.AppendUint16(script, uint16(n))
+	}
+	return append(script, data...)
+}
+
+// ScriptPushInt appends a push of n, using OP_0 to OP_16 when possible.
+func ScriptPushInt(script []byte, n int64) []byte {
+	if n == 0 {
+		return append(script, OP_0)
+	}
+	if n >= 1 && n <= 16 {
+		return append(script, byte(OP_1+n-1))
+	}
+	return ScriptPush(script, encodeNum(n))
+}
+
+// encodeNum writes n little endian with the sign in the top bit of the
+// last byte, the way Bitcoin script numbers are encoded.
+func encodeNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	neg := n < 0
+	abs := uint64(n)
+	if neg {
+		abs = uint64(-n)
+	}
+	var out []byte
+	for abs > 0 {
+		out = append(out, byte(abs))
+		abs >>= 8
+	}
+	if out[len(out)-1]&0x80 != 0 {
+		out = append(out, 0)
+	}
+	if neg {
+		out[len(out)-1] |= 0x80
+	}
+	return out
+}
+
+func decodeNum(b []byte) (int64, error) {
+	if len(b) > maxNumSize {
+		return 0, fmt.Errorf("%w: number too long", ErrBadScript)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var n int64
+	for i, c := range b {
+		n |= int64(c) << (8 * i)
+	}
+	if b[len(b)-1]&0x80 != 0 {
+		n &^= int64(0x80) << (8 * (len(b) - 1))
+		n = -n
+	}
+	return n, nil
+}
+
+func asBool(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// PayToPubKeyHash is the locking script of an ordinary address.
+func PayToPubKeyHash(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = ScriptPush(script, pubKeyHash)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// PubKeyHashSig is the unlocking script for a PayToPubKeyHash output.
+func PubKeyHashSig(signature, pubKey []byte) []byte {
+	return ScriptPush(ScriptPush(nil, signature), pubKey)
+}
+
+// ExtractPubKeyHash returns the hash a PayToPubKeyHash script is locked to,
+// or nil for any other script.
+func ExtractPubKeyHash(script []byte) []byte {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 5 {
+		return nil
+	}
+	if ops[0].code != OP_DUP || ops[1].code != OP_HASH160 || len(ops[2].data) != 20 ||
+		ops[3].code != OP_EQUALVERIFY || ops[4].code != OP_CHECKSIG {
+		return nil
+	}
+	return ops[2].data
+}
+
+// PayToScriptHash locks an output to the hash of a redeem script. The
+// spender pushes the redeem script after the data that satisfies it.
+func PayToScriptHash(scriptHash []byte) []byte {
+	script := []byte{OP_HASH160}
+	script = ScriptPush(script, scriptHash)
+	return append(script, OP_EQUAL)
+}
+
+// ExtractScriptHash returns the hash a PayToScriptHash script is locked to,
+// or nil for any other script.
+func ExtractScriptHash(script []byte) []byte {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 3 {
+		return nil
+	}
+	if ops[0].code != OP_HASH160 || len(ops[1].data) != 20 || ops[2].code != OP_EQUAL {
+		return nil
+	}
+	return ops[1].data
+}
+
+// DataScript is a provably unspendable locking script carrying data, used
+// to anchor hashes in the chain.
+func DataScript(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data) > MaxDataSize {
+		return nil, fmt.Errorf("%w: %d bytes of data, at most %d allowed", ErrBadScript, len(data), MaxDataSize)
+	}
+	return ScriptPush([]byte{OP_RETURN}, data), nil
+}
+
+// ExtractData returns the payload of a DataScript, or nil for any other
+// script.
+func ExtractData(script []byte) []byte {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 2 || ops[0].code != OP_RETURN || !ops[1].isPush() {
+		return nil
+	}
+	if len(ops[1].data) == 0 || len(ops[1].data) > MaxDataSize {
+		return nil
+	}
+	return ops[1].data
+}
+
+// IsUnspendable reports whether no input can ever spend an output locked
+// with script. Such outputs are kept out of the UTXO set.
+func IsUnspendable(script []byte) bool {
+	return len(script) > 0 && script[0] == OP_RETURN || len(script) > MaxScriptSize
+}
+
+// MultisigScript requires m signatures from the n public keys, given in the
+// order the signatures must follow.
+func MultisigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	if len(pubKeys) < 1 || len(pubKeys) > MaxMultisigKeys || m < 1 || m > len(pubKeys) {
+		return nil, fmt.Errorf("%w: %d of %d keys", ErrBadScript, m, len(pubKeys))
+	}
+	script := ScriptPushInt(nil, int64(m))
+	for _, key := range pubKeys {
+		if _, err := parsePubKey(key); err != nil {
+			return nil, err
+		}
+		script = ScriptPush(script, key)
+	}
+	script = ScriptPushInt(script, int64(len(pubKeys)))
+	return append(script, OP_CHECKMULTISIG), nil
+}
+
+// ParseMultisig returns the signatures required and the keys of a script
+// built by MultisigScript.
+func ParseMultisig(script []byte) (int, [][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return 0, nil, err
+	}
+	bad := fmt.Errorf("%w: not a multisig script", ErrBadScript)
+	if len(ops) < 4 || ops[len(ops)-1].code != OP_CHECKMULTISIG {
+		return 0, nil, bad
+	}
+	small := func(op scriptOp) int {
+		if op.code < OP_1 || op.code > OP_16 {
+			return 0
+		}
+		return int(op.code-OP_1) + 1
+	}
+	m, n := small(ops[0]), small(ops[len(ops)-2])
+	if m == 0 || n != len(ops)-3 || m > n {
+		return 0, nil, bad
+	}
+	var keys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.code == OP_0 || !op.isPush() || small(op) != 0 {
+			return 0, nil, bad
+		}
+		keys = append(keys, op.data)
+	}
+	return m, keys, nil
+}
+
+// MultisigAddress is the address paying to the hash of a redeem script.
+func MultisigAddress(redeem []byte) []byte {
+	return wallet.EncodeAddress(wallet.ScriptVersion, wallet.PublicKeyHash(redeem))
+}
+
+// DisasmScript renders a script as opcodes and hex pushes.
+func DisasmScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid %x]", script)
+	}
+	var parts []string
+	for _, op := range ops {
+		switch {
+		case op.code >= OP_1 && op.code <= OP_16:
+			parts = append(parts, fmt.Sprintf("OP_%d", op.code-OP_1+1))
+		case op.code != OP_0 && op.isPush():
+			parts = append(parts, hex.EncodeToString(op.data))
+		case opNames[op.code] != "":
+			parts = append(parts, opNames[op.code])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN_%02x", op.code))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// scriptEngine runs an unlocking script followed by the locking script of
+// the output it spends.
+type scriptEngine struct {
+	stack  [][]byte
+	tx     *Transaction
+	inIdx  int
+	prev   []byte
+	values []uint64
+}
+
+// VerifyScript checks that input inIdx of tx may spend an output locked
+// with prevScript. values holds what the output spent by each input of tx
+// is worth.
+func VerifyScript(tx *Transaction, inIdx int, prevScript []byte, values []uint64) error {
+	unlock, err := parseScript(tx.Inputs[inIdx].ScriptSig)
+	if err != nil {
+		return err
+	}
+	for _, op := range unlock {
+		if !op.isPush() {
+			return fmt.Errorf("%w: unlocking script must only push data", ErrBadScript)
+		}
+	}
+	lock, err := parseScript(prevScript)
+	if err != nil {
+		return err
+	}
+	vm := &scriptEngine{tx: tx, inIdx: inIdx, prev: prevScript, values: values}
+	if err := vm.run(unlock); err != nil {
+		return err
+	}
+	unlocked := append([][]byte{}, vm.stack...)
+	if err := vm.run(lock); err != nil {
+		return err
+	}
+	if len(vm.stack) == 0 || !asBool(vm.stack[len(vm.stack)-1]) {
+		return ErrScriptFailed
+	}
+	if ExtractScriptHash(prevScript) == nil {
+		return nil
+	}
+	// the hash matched, now the redeem script has to be satisfied by the
+	// rest of the unlocking data
+	vm.stack = unlocked
+	redeem, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	ops, err := parseScript(redeem)
+	if err != nil {
+		return err
+	}
+	vm.prev = redeem
+	if err := vm.run(ops); err != nil {
+		return err
+	}
+	if len(vm.stack) == 0 || !asBool(vm.stack[len(vm.stack)-1]) {
+		return ErrScriptFailed
+	}
+	return nil
+}
+
+func (vm *scriptEngine) push(b []byte) error {
+	if len(vm.stack) >= MaxStackSize {
+		return fmt.Errorf("%w: stack overflow", ErrBadScript)
+	}
+	vm.stack = append(vm.stack, b)
+	return nil
+}
+
+func (vm *scriptEngine) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack underflow", ErrBadScript)
+	}
+	top := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return top, nil
+}
+
+func (vm *scriptEngine) popNum() (int64, error) {
+	b, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeNum(b)
+}
+
+// peekNum reads the number on top of the stack without removing it.
+func (vm *scriptEngine) peekNum() (int64, error) {
+	if len(vm.stack) == 0 {
+		return 0, fmt.Errorf("%w: stack underflow", ErrBadScript)
+	}
+	return decodeNum(vm.stack[len(vm.stack)-1])
+}
+
+func (vm *scriptEngine) pushBool(v bool) error {
+	if v {
+		return vm.push([]byte{1})
+	}
+	return vm.push(nil)
+}
+
+func (vm *scriptEngine) run(ops []scriptOp) error {
+	for _, op := range ops {
+		if err := vm.step(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *scriptEngine) step(op scriptOp) error {
+	switch {
+	case op.code >= OP_1 && op.code <= OP_16:
+		return vm.push(encodeNum(int64(op.code - OP_1 + 1)))
+	case op.isPush():
+		return vm.push(op.data)
+	}
+	switch op.code {
+	case OP_VERIFY:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if !asBool(top) {
+			return ErrScriptFailed
+		}
+	case OP_RETURN:
+		return fmt.Errorf("%w: OP_RETURN", ErrScriptFailed)
+	case OP_DROP:
+		_, err := vm.pop()
+		return err
+	case OP_DUP:
+		if len(vm.stack) == 0 {
+			return fmt.Errorf("%w: stack underflow", ErrBadScript)
+		}
+		return vm.push(vm.stack[len(vm.stack)-1])
+	case OP_HASH160:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		return vm.push(wallet.PublicKeyHash(top))
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if op.code == OP_EQUALVERIFY {
+			if !bytes.Equal(a, b) {
+				return ErrScriptFailed
+			}
+			return nil
+		}
+		return vm.pushBool(bytes.Equal(a, b))
+	case OP_CHECKSIG:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		ok, err := vm.checkSig(sig, pubKey)
+		if err != nil {
+			return err
+		}
+		return vm.pushBool(ok)
+	case OP_CHECKMULTISIG:
+		return vm.checkMultisig()
+	case OP_CHECKLOCKTIMEVERIFY:
+		// the operand stays on the stack, scripts follow it with OP_DROP.
+		// Block validation makes sure the transaction's own lock time has
+		// passed.
+		lockTime, err := vm.peekNum()
+		if err != nil {
+			return err
+		}
+		if lockTime < 0 || LockTimeIsHeight(lockTime) != LockTimeIsHeight(vm.tx.LockTime) || vm.tx.LockTime < lockTime {
+			return fmt.Errorf("%w: locked until %d", ErrScriptFailed, lockTime)
+		}
+	case OP_CHECKSEQUENCEVERIFY:
+		// like OP_CHECKLOCKTIMEVERIFY, against the relative lock of the
+		// spending input
+		seq, err := vm.peekNum()
+		if err != nil {
+			return err
+		}
+		inSeq := int64(vm.tx.Inputs[vm.inIdx].Sequence)
+		if seq < 0 || seq&SequenceLockSeconds != inSeq&SequenceLockSeconds || inSeq&SequenceLockMask < seq&SequenceLockMask {
+			return fmt.Errorf("%w: relative lock %s", ErrScriptFailed, sequenceString(uint32(seq)))
+		}
+	default:
+		return fmt.Errorf("%w: unknown opcode %02x", ErrBadScript, op.code)
+	}
+	return nil
+}
+
+// checkMultisig pops n, n public keys, m and m signatures. The signatures
+// must appear in the same order as the keys they belong to.
+func (vm *scriptEngine) checkMultisig() error {
+	n, err := vm.popNum()
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > MaxMultisigKeys {
+		return fmt.Errorf("%w: %d keys", ErrBadScript, n)
+	}
+	keys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if keys[i], err = vm.pop(); err != nil {
+			return err
+		}
+	}
+	m, err := vm.popNum()
+	if err != nil {
+		return err
+	}
+	if m < 1 || m > n {
+		return fmt.Errorf("%w: %d of %d signatures", ErrBadScript, m, n)
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = vm.pop(); err != nil {
+			return err
+		}
+	}
+	k := 0
+	for _, sig := range sigs {
+		for ; k < len(keys); k++ {
+			ok, err := vm.checkSig(sig, keys[k])
+			if err != nil {
+				return err
+			}
+			if ok {
+				break
+			}
+		}
+		if k == len(keys) {
+			return vm.pushBool(false)
+		}
+		k++
+	}
+	return vm.pushBool(true)
+}
+
+// checkSig verifies a signature followed by its hash type byte. An empty
+// signature is simply false, a malformed one or key is an error.
+func (vm *scriptEngine) checkSig(sig, pubKey []byte) (bool, error) {
+	if len(sig) == 0 {
+		return false, nil
+	}
+	hashType := SigHashType(sig[len(sig)-1])
+	r, s, err := parseSignature(sig[:len(sig)-1])
+	if err != nil {
+		return false, err
+	}
+	key, err := parsePubKey(pubKey)
+	if err != nil {
+		return false, err
+	}
+	digest, err := vm.tx.SigHash(vm.inIdx, vm.prev, vm.values, hashType)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrBadScript, err)
+	}
+	return ecdsa.Verify(key, digest, r, s), nil
+}
@@ -0,0 +1,301 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+	"zeechain/wallet"
+)
+
+// spentValue is what the output spent by spendTx is worth.
+var spentValue = []uint64{10}
+
+// spendTx spends a single output into a payment of 5 coins and a data
+// output.
+func spendTx() *Transaction {
+	data, _ := DataScript([]byte("out"))
+	return &Transaction{
+		Date:    time.Unix(1600000000, 0),
+		Inputs:  []TransInput{{ID: []byte{0x01}, OutId: 0}},
+		Outputs: []TransOutput{{Value: 5, ScriptPubKey: PayToPubKeyHash(make([]byte, 20))}, {ScriptPubKey: data}},
+	}
+}
+
+func sign(t *testing.T, tx *Transaction, w *wallet.Wallet, script []byte) []byte {
+	t.Helper()
+	sig, err := tx.signInput(0, &w.PrivateKey, script, spentValue, SigHashAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestPayToPubKeyHash(t *testing.T) {
+	w, other := wallet.NewWallet(), wallet.NewWallet()
+	prev := PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))
+	if !bytes.Equal(ExtractPubKeyHash(prev), wallet.PublicKeyHash(w.PublicKey)) {
+		t.Fatal("ExtractPubKeyHash does not find the hash")
+	}
+
+	tx := spendTx()
+	tx.Inputs[0].ScriptSig = PubKeyHashSig(sign(t, tx, w, prev), w.PublicKey)
+	if err := VerifyScript(tx, 0, prev, spentValue); err != nil {
+		t.Errorf("valid spend: %v", err)
+	}
+
+	tx.Outputs[0].Value++
+	if err := VerifyScript(tx, 0, prev, spentValue); !errors.Is(err, ErrScriptFailed) {
+		t.Errorf("changed output: err = %v, want %v", err, ErrScriptFailed)
+	}
+	tx.Outputs[0].Value--
+
+	tx.Inputs[0].ScriptSig = PubKeyHashSig(sign(t, tx, other, prev), other.PublicKey)
+	if err := VerifyScript(tx, 0, prev, spentValue); !errors.Is(err, ErrScriptFailed) {
+		t.Errorf("wrong key: err = %v, want %v", err, ErrScriptFailed)
+	}
+
+	// a key that hashes right but signed something else
+	sig := sign(t, tx, other, prev)
+	tx.Inputs[0].ScriptSig = PubKeyHashSig(sig, w.PublicKey)
+	if err := VerifyScript(tx, 0, prev, spentValue); !errors.Is(err, ErrScriptFailed) {
+		t.Errorf("foreign signature: err = %v, want %v", err, ErrScriptFailed)
+	}
+
+	// unlocking scripts may only push data
+	tx.Inputs[0].ScriptSig = append(PubKeyHashSig(sign(t, tx, w, prev), w.PublicKey), OP_DROP)
+	if err := VerifyScript(tx, 0, prev, spentValue); !errors.Is(err, ErrBadScript) {
+		t.Errorf("opcode in unlocking script: err = %v, want %v", err, ErrBadScript)
+	}
+}
+
+func TestSigHashCommitsToValues(t *testing.T) {
+	w := wallet.NewWallet()
+	prev := PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))
+	tx := spendTx()
+	tx.Inputs = append(tx.Inputs, TransInput{ID: []byte{0x02}, OutId: 1})
+	values := []uint64{10, 20}
+	for _, hashType := range []SigHashType{SigHashAll, SigHashAll | SigHashAnyoneCanPay} {
+		sig, err := tx.signInput(0, &w.PrivateKey, prev, values, hashType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Inputs[0].ScriptSig = PubKeyHashSig(sig, w.PublicKey)
+		if err := VerifyScript(tx, 0, prev, values); err != nil {
+			t.Errorf("%s: %v", hashType, err)
+		}
+		if err := VerifyScript(tx, 0, prev, []uint64{11, 20}); !errors.Is(err, ErrScriptFailed) {
+			t.Errorf("%s with another value for the signed input: err = %v, want %v", hashType, err, ErrScriptFailed)
+		}
+		// only the inputs a signature covers have their values signed
+		err = VerifyScript(tx, 0, prev, []uint64{10, 21})
+		if anyone := hashType&SigHashAnyoneCanPay != 0; anyone && err != nil || !anyone && !errors.Is(err, ErrScriptFailed) {
+			t.Errorf("%s with another value for the other input: err = %v", hashType, err)
+		}
+	}
+	if _, err := tx.SigHash(0, prev, values[:1], SigHashAll); !errors.Is(err, ErrBadSigHash) {
+		t.Errorf("missing input value: err = %v, want %v", err, ErrBadSigHash)
+	}
+}
+
+func TestSignWithHashType(t *testing.T) {
+	w := wallet.NewWallet()
+	prevTx := Transaction{ID: []byte{0x01}, Outputs: []TransOutput{{Value: spentValue[0], ScriptPubKey: PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))}}}
+	prevTxs := map[string]Transaction{"01": prevTx}
+	for _, test := range []struct {
+		hashType SigHashType
+		open     bool // whether the outputs may change after signing
+	}{{SigHashAll, false}, {SigHashNone, true}, {SigHashNone | SigHashAnyoneCanPay, true}} {
+		tx := spendTx()
+		if err := tx.Sign(w.PrivateKey, prevTxs, test.hashType); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := tx.Verify(prevTxs); !ok || err != nil {
+			t.Errorf("%s: verify = %v, %v", test.hashType, ok, err)
+		}
+		tx.Outputs[0].Value--
+		if ok, err := tx.Verify(prevTxs); ok != test.open || err != nil {
+			t.Errorf("%s with a changed output: verify = %v, %v; want %v", test.hashType, ok, err, test.open)
+		}
+	}
+}
+
+func TestPayToScriptHashMultisig(t *testing.T) {
+	keys := []*wallet.Wallet{wallet.NewWallet(), wallet.NewWallet(), wallet.NewWallet()}
+	var pubKeys [][]byte
+	for _, w := range keys {
+		pubKeys = append(pubKeys, w.PublicKey)
+	}
+	redeem, err := MultisigScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, parsed, err := ParseMultisig(redeem)
+	if err != nil || m != 2 || len(parsed) != 3 {
+		t.Fatalf("ParseMultisig = %d, %d keys, %v", m, len(parsed), err)
+	}
+	prev := PayToScriptHash(wallet.PublicKeyHash(redeem))
+	tx := spendTx()
+	sigs := make([][]byte, len(keys))
+	for i, w := range keys {
+		sigs[i] = sign(t, tx, w, redeem)
+	}
+	unlock := func(sigs ...[]byte) []byte {
+		var script []byte
+		for _, sig := range sigs {
+			script = ScriptPush(script, sig)
+		}
+		return ScriptPush(script, redeem)
+	}
+
+	for _, pair := range [][2]int{{0, 1}, {0, 2}, {1, 2}} {
+		tx.Inputs[0].ScriptSig = unlock(sigs[pair[0]], sigs[pair[1]])
+		if err := VerifyScript(tx, 0, prev, spentValue); err != nil {
+			t.Errorf("signatures %v: %v", pair, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		script []byte
+		want   error
+	}{
+		{"out of order", unlock(sigs[1], sigs[0]), ErrScriptFailed},
+		{"same signature twice", unlock(sigs[0], sigs[0]), ErrScriptFailed},
+		{"one signature", unlock(sigs[0]), ErrBadScript},
+		{"other redeem script", ScriptPush(ScriptPush(ScriptPush(nil, sigs[0]), sigs[1]), PayToPubKeyHash(make([]byte, 20))), ErrScriptFailed},
+	}
+	for _, test := range tests {
+		tx.Inputs[0].ScriptSig = test.script
+		if err := VerifyScript(tx, 0, prev, spentValue); !errors.Is(err, test.want) {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if _, err := MultisigScript(3, pubKeys[:2]); !errors.Is(err, ErrBadScript) {
+		t.Errorf("3 of 2: err = %v, want %v", err, ErrBadScript)
+	}
+}
+
+func TestCheckLockTimeVerify(t *testing.T) {
+	w := wallet.NewWallet()
+	lock := func(lockTime int64) []byte {
+		script := ScriptPushInt(nil, lockTime)
+		script = append(script, OP_CHECKLOCKTIMEVERIFY, OP_DROP)
+		return append(script, PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))...)
+	}
+	tests := []struct {
+		lock, txLock int64
+		ok           bool
+	}{
+		{100, 100, true},
+		{100, 150, true},
+		{100, 99, false},
+		{100, LockTimeThreshold + 100, false},
+		{LockTimeThreshold + 100, LockTimeThreshold + 100, true},
+		{LockTimeThreshold + 100, 100, false},
+		{-1, 100, false},
+	}
+	for _, test := range tests {
+		prev := lock(test.lock)
+		tx := spendTx()
+		tx.LockTime = test.txLock
+		tx.Inputs[0].ScriptSig = PubKeyHashSig(sign(t, tx, w, prev), w.PublicKey)
+		err := VerifyScript(tx, 0, prev, spentValue)
+		if (err == nil) != test.ok {
+			t.Errorf("lock %d, tx lock time %d: err = %v", test.lock, test.txLock, err)
+		}
+	}
+}
+
+func TestCheckSequenceVerify(t *testing.T) {
+	lock := func(seq uint32) []byte {
+		script := ScriptPushInt(nil, int64(seq))
+		return append(script, OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1)
+	}
+	tests := []struct {
+		lock, sequence uint32
+		ok             bool
+	}{
+		{RelativeLock(10), RelativeLock(10), true},
+		{RelativeLock(10), RelativeLock(11), true},
+		{RelativeLock(10), RelativeLock(9), false},
+		{RelativeLock(10), RelativeTimeLock(10 << sequenceGranularity), false},
+		{RelativeTimeLock(1024), RelativeTimeLock(1024), true},
+		{RelativeTimeLock(1024), RelativeTimeLock(512), false},
+	}
+	for _, test := range tests {
+		tx := spendTx()
+		tx.Inputs[0].Sequence = test.sequence
+		err := VerifyScript(tx, 0, lock(test.lock), spentValue)
+		if (err == nil) != test.ok {
+			t.Errorf("lock %s, sequence %s: err = %v", sequenceString(test.lock), sequenceString(test.sequence), err)
+		}
+	}
+}
+
+func TestDataScript(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xab}, MaxDataSize)
+	script, err := DataScript(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsUnspendable(script) || !bytes.Equal(ExtractData(script), payload) {
+		t.Errorf("DataScript(%d bytes) is not a data output", len(payload))
+	}
+	if err := VerifyScript(spendTx(), 0, script, spentValue); !errors.Is(err, ErrScriptFailed) {
+		t.Errorf("spending a data output: err = %v, want %v", err, ErrScriptFailed)
+	}
+	for _, n := range []int{0, MaxDataSize + 1} {
+		if _, err := DataScript(make([]byte, n)); !errors.Is(err, ErrBadScript) {
+			t.Errorf("DataScript(%d bytes): err = %v, want %v", n, err, ErrBadScript)
+		}
+	}
+	// a push too long for a data output is still unspendable, but carries
+	// no data and so is not standard
+	long := ScriptPush([]byte{OP_RETURN}, make([]byte, MaxDataSize+1))
+	if !IsUnspendable(long) || ExtractData(long) != nil {
+		t.Error("oversized data push is accepted as a data output")
+	}
+}
+
+func TestMalformedScripts(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []byte
+	}{
+		{"truncated direct push", []byte{0x05, 1, 2}},
+		{"truncated PUSHDATA1 length", []byte{OP_PUSHDATA1}},
+		{"truncated PUSHDATA1", []byte{OP_PUSHDATA1, 3, 1}},
+		{"truncated PUSHDATA2 length", []byte{OP_PUSHDATA2, 0}},
+		{"truncated PUSHDATA2", []byte{OP_PUSHDATA2, 0x01, 0x00, 1}},
+		{"oversized script", append([]byte{OP_1}, make([]byte, MaxScriptSize)...)},
+		{"unknown opcode", []byte{OP_1, 0xff}},
+		{"stack underflow", []byte{OP_DUP}},
+		{"number too long", append(ScriptPush(nil, make([]byte, maxNumSize+1)), OP_CHECKSEQUENCEVERIFY)},
+	}
+	for _, test := range tests {
+		if err := VerifyScript(spendTx(), 0, test.script, spentValue); !errors.Is(err, ErrBadScript) {
+			t.Errorf("%s: err = %v, want %v", test.name, err, ErrBadScript)
+		}
+	}
+	if !IsUnspendable(make([]byte, MaxScriptSize+1)) {
+		t.Error("a script over the size limit is spendable")
+	}
+}
+
+func TestScriptPush(t *testing.T) {
+	for _, n := range []int{0, 1, OP_PUSHDATA1 - 1, OP_PUSHDATA1, 0xff, 0x100, MaxScriptSize - 3} {
+		data := bytes.Repeat([]byte{0x42}, n)
+		ops, err := parseScript(ScriptPush(nil, data))
+		if err != nil || len(ops) != 1 || !bytes.Equal(ops[0].data, data) {
+			t.Errorf("push of %d bytes parses as %d ops, %v", n, len(ops), err)
+		}
+	}
+	for _, n := range []int64{0, 1, 16, 17, 127, 128, 255, -1, -128, LockTimeThreshold} {
+		got, err := decodeNum(encodeNum(n))
+		if err != nil || got != n {
+			t.Errorf("number %d decodes as %d, %v", n, got, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package blockchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SigHashType says which parts of a transaction a signature commits to. It
+// is appended to every signature as its last byte.
+type SigHashType byte
+
+const (
+	// every input and output
+	SigHashAll SigHashType = 0x01
+	// the inputs but no output, anyone may decide where the coins go
+	SigHashNone SigHashType = 0x02
+	// the inputs and the output at the same position as the signed input
+	SigHashSingle SigHashType = 0x03
+	// combined with the above, only the signed input, so others can add
+	// inputs of their own
+	SigHashAnyoneCanPay SigHashType = 0x80
+
+	sigHashBaseMask = 0x1f
+)
+
+var ErrBadSigHash = errors.New("invalid signature hash type")
+
+func (t SigHashType) base() SigHashType {
+	return t & sigHashBaseMask
+}
+
+func (t SigHashType) valid() bool {
+	return t&^(SigHashAnyoneCanPay|sigHashBaseMask) == 0 && t.base() >= SigHashAll && t.base() <= SigHashSingle
+}
+
+func (t SigHashType) String() string {
+	var name string
+	switch t.base() {
+	case SigHashAll:
+		name = "ALL"
+	case SigHashNone:
+		name = "NONE"
+	case SigHashSingle:
+		name = "SINGLE"
+	default:
+		return fmt.Sprintf("SIGHASH_%02x", byte(t))
+	}
+	if t&SigHashAnyoneCanPay != 0 {
+		name += "|ANYONECANPAY"
+	}
+	return name
+}
+
+// ParseSigHashType reads ALL, NONE or SINGLE, optionally followed by
+// |ANYONECANPAY.
+func ParseSigHashType(s string) (SigHashType, error) {
+	base, flag, anyone := strings.Cut(strings.ToUpper(s), "|")
+	var t SigHashType
+	switch base {
+	case "ALL":
+		t = SigHashAll
+	case "NONE":
+		t = SigHashNone
+	case "SINGLE":
+		t = SigHashSingle
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrBadSigHash, s)
+	}
+	if anyone {
+		if flag != "ANYONECANPAY" {
+			return 0, fmt.Errorf("%w: %q", ErrBadSigHash, s)
+		}
+		t |= SigHashAnyoneCanPay
+	}
+	return t, nil
+}
+
+// SigHash is the digest signed for input inIdx: the transaction without its
+// ID and unlocking scripts, where the input being signed carries the locking
+// script of the output it spends, cut down to what hashType covers. values
+// holds what the output spent by each input is worth. The values of the
+// inputs covered are signed too, so a signer cannot be misled about the fee.
+func (tx *Transaction) SigHash(inIdx int, prevScript []byte, values []uint64, hashType SigHashType) ([]byte, error) {
+	if !hashType.valid() {
+		return nil, fmt.Errorf("%w: %02x", ErrBadSigHash, byte(hashType))
+	}
+	if len(values) != len(tx.Inputs) {
+		return nil, fmt.Errorf("%w: %d input values for %d inputs", ErrBadSigHash, len(values), len(tx.Inputs))
+	}
+	txCopy := tx.TrimmedCopy()
+	txCopy.ID = nil
+	txCopy.Inputs[inIdx].ScriptSig = prevScript
+	switch hashType.base() {
+	case SigHashNone:
+		txCopy.Outputs = nil
+	case SigHashSingle:
+		if inIdx >= len(txCopy.Outputs) {
+			return nil, fmt.Errorf("%w: SINGLE for input %d without a matching output", ErrBadSigHash, inIdx)
+		}
+		// earlier outputs are left blank, their position still counts
+		txCopy.Outputs = txCopy.Outputs[:inIdx+1]
+		for i := range inIdx {
+			txCopy.Outputs[i] = TransOutput{}
+		}
+	}
+	if hashType.base() != SigHashAll {
+		// other signers may still change their relative locks
+		for i := range txCopy.Inputs {
+			if i != inIdx {
+				txCopy.Inputs[i].Sequence = 0
+			}
+		}
+	}
+	if hashType&SigHashAnyoneCanPay != 0 {
+		txCopy.Inputs = txCopy.Inputs[inIdx : inIdx+1]
+		values = values[inIdx : inIdx+1]
+	}
+	data := txCopy.Serialize()
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint64(data, value)
+	}
+	hash := sha256.Sum256(append(data, byte(hashType)))
+	return hash[:], nil
+}
+
+// signInput signs input inIdx, spending an output locked with prevScript,
+// and returns the signature with hashType appended.
+func (tx *Transaction) signInput(inIdx int, privKey *ecdsa.PrivateKey, prevScript []byte, values []uint64, hashType SigHashType) ([]byte, error) {
+	digest, err := tx.SigHash(inIdx, prevScript, values, hashType)
+	if err != nil {
+		return nil, err
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, privKey, digest)
+	if err != nil {
+		return nil, err
+	}
+	return append(encodeSignature(r, s), byte(hashType)), nil
+}
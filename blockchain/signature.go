@@ -0,0 +1,66 @@
+package blockchain
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"fmt"
+	"math/big"
+	"zeechain/wallet"
+)
+
+// SignatureLength is the size of an encoded signature before its hash type:
+// r and s, each padded to 32 bytes.
+const SignatureLength = 64
+
+var (
+	curveOrder = elliptic.P256().Params().N
+	halfOrder  = new(big.Int).Rsh(curveOrder, 1)
+)
+
+// encodeSignature writes r and s at fixed width. s is replaced by N - s when
+// it is in the upper half of the curve order, since both verify and only the
+// low one is accepted.
+func encodeSignature(r, s *big.Int) []byte {
+	if s.Cmp(halfOrder) > 0 {
+		s = new(big.Int).Sub(curveOrder, s)
+	}
+	sig := make([]byte, SignatureLength)
+	r.FillBytes(sig[:SignatureLength/2])
+	s.FillBytes(sig[SignatureLength/2:])
+	return sig
+}
+
+// parseSignature reads a signature written by encodeSignature. Anything
+// else, including a high s, is rejected so a signature cannot be altered
+// into another valid one without the key.
+func parseSignature(sig []byte) (*big.Int, *big.Int, error) {
+	if len(sig) != SignatureLength {
+		return nil, nil, fmt.Errorf("%w: signature is %d bytes, want %d", ErrBadScript, len(sig), SignatureLength)
+	}
+	r := new(big.Int).SetBytes(sig[:SignatureLength/2])
+	s := new(big.Int).SetBytes(sig[SignatureLength/2:])
+	if r.Sign() == 0 || r.Cmp(curveOrder) >= 0 || s.Sign() == 0 {
+		return nil, nil, fmt.Errorf("%w: signature out of range", ErrBadScript)
+	}
+	if s.Cmp(halfOrder) > 0 {
+		return nil, nil, fmt.Errorf("%w: signature has a high s", ErrBadScript)
+	}
+	return r, s, nil
+}
+
+// parsePubKey reads a key written by wallet.PublicKeyBytes, which must be a
+// point on the curve.
+func parsePubKey(pubKey []byte) (*ecdsa.PublicKey, error) {
+	if len(pubKey) != wallet.PublicKeyLength {
+		return nil, fmt.Errorf("%w: public key is %d bytes, want %d", ErrBadScript, len(pubKey), wallet.PublicKeyLength)
+	}
+	if _, err := ecdh.P256().NewPublicKey(append([]byte{4}, pubKey...)); err != nil {
+		return nil, fmt.Errorf("%w: public key is not on the curve", ErrBadScript)
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(pubKey[:wallet.PublicKeyLength/2]),
+		Y:     new(big.Int).SetBytes(pubKey[wallet.PublicKeyLength/2:]),
+	}, nil
+}
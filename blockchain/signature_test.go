@@ -0,0 +1,142 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"math/big"
+	"testing"
+	"zeechain/wallet"
+)
+
+// walletFor builds a wallet around the private key d.
+func walletFor(d *big.Int) *wallet.Wallet {
+	curve := elliptic.P256()
+	priv := ecdsa.PrivateKey{D: d}
+	priv.Curve = curve
+	priv.X, priv.Y = curve.ScalarBaseMult(d.Bytes())
+	return &wallet.Wallet{PrivateKey: priv, PublicKey: wallet.PublicKeyBytes(&priv.PublicKey)}
+}
+
+// shortKey returns the first wallet, counting up from d = 2, whose public
+// key has a coordinate below 2^248, so the plain big-endian bytes of that
+// coordinate would be a byte short.
+func shortKey(t *testing.T, coord func(*ecdsa.PublicKey) *big.Int) *wallet.Wallet {
+	t.Helper()
+	for d := int64(2); d < 1<<16; d++ {
+		w := walletFor(big.NewInt(d))
+		if len(coord(&w.PrivateKey.PublicKey).Bytes()) < wallet.PublicKeyLength/2 {
+			return w
+		}
+	}
+	t.Fatal("no short key found")
+	return nil
+}
+
+func TestEdgeCaseKeys(t *testing.T) {
+	keys := map[string]*wallet.Wallet{
+		"d=1":     walletFor(big.NewInt(1)),
+		"d=N-1":   walletFor(new(big.Int).Sub(curveOrder, big.NewInt(1))),
+		"short X": shortKey(t, func(k *ecdsa.PublicKey) *big.Int { return k.X }),
+		"short Y": shortKey(t, func(k *ecdsa.PublicKey) *big.Int { return k.Y }),
+	}
+	for name, w := range keys {
+		if len(w.PublicKey) != wallet.PublicKeyLength {
+			t.Errorf("%s: public key is %d bytes, want %d", name, len(w.PublicKey), wallet.PublicKeyLength)
+			continue
+		}
+		key, err := parsePubKey(w.PublicKey)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if key.X.Cmp(w.PrivateKey.X) != 0 || key.Y.Cmp(w.PrivateKey.Y) != 0 {
+			t.Errorf("%s: public key does not parse back to the same point", name)
+		}
+
+		prev := PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))
+		tx := spendTx()
+		tx.Inputs[0].ScriptSig = PubKeyHashSig(sign(t, tx, w, prev), w.PublicKey)
+		if err := VerifyScript(tx, 0, prev, spentValue); err != nil {
+			t.Errorf("%s: spend: %v", name, err)
+		}
+	}
+}
+
+func TestSignatureEncoding(t *testing.T) {
+	// values with leading zero bytes keep their place
+	r, s := big.NewInt(1), big.NewInt(2)
+	sig := encodeSignature(r, s)
+	if len(sig) != SignatureLength {
+		t.Fatalf("signature is %d bytes, want %d", len(sig), SignatureLength)
+	}
+	gotR, gotS, err := parseSignature(sig)
+	if err != nil || gotR.Cmp(r) != 0 || gotS.Cmp(s) != 0 {
+		t.Errorf("parses as %v, %v, %v; want %v, %v", gotR, gotS, err, r, s)
+	}
+
+	// a high s is normalized when encoding
+	high := new(big.Int).Sub(curveOrder, s)
+	if _, gotS, err := parseSignature(encodeSignature(r, high)); err != nil || gotS.Cmp(s) != 0 {
+		t.Errorf("high s encodes as %v, %v; want %v", gotS, err, s)
+	}
+
+	bad := map[string][]byte{
+		"empty":    {},
+		"short":    sig[:SignatureLength-1],
+		"long":     append(bytes.Clone(sig), 0),
+		"zero r":   append(make([]byte, SignatureLength/2), sig[SignatureLength/2:]...),
+		"zero s":   append(bytes.Clone(sig[:SignatureLength/2]), make([]byte, SignatureLength/2)...),
+		"r over N": append(curveOrder.FillBytes(make([]byte, SignatureLength/2)), sig[SignatureLength/2:]...),
+		"high s":   append(bytes.Clone(sig[:SignatureLength/2]), high.FillBytes(make([]byte, SignatureLength/2))...),
+	}
+	for name, sig := range bad {
+		if _, _, err := parseSignature(sig); !errors.Is(err, ErrBadScript) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrBadScript)
+		}
+	}
+}
+
+func TestHighSRejected(t *testing.T) {
+	w := wallet.NewWallet()
+	prev := PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))
+	tx := spendTx()
+	sig := sign(t, tx, w, prev)
+
+	// N - s verifies under plain ECDSA but must not be accepted
+	s := new(big.Int).SetBytes(sig[SignatureLength/2 : SignatureLength])
+	new(big.Int).Sub(curveOrder, s).FillBytes(sig[SignatureLength/2 : SignatureLength])
+	tx.Inputs[0].ScriptSig = PubKeyHashSig(sig, w.PublicKey)
+	if err := VerifyScript(tx, 0, prev, spentValue); !errors.Is(err, ErrBadScript) {
+		t.Errorf("err = %v, want %v", err, ErrBadScript)
+	}
+}
+
+func TestMalformedPublicKeys(t *testing.T) {
+	w := wallet.NewWallet()
+	offCurve := bytes.Clone(w.PublicKey)
+	offCurve[len(offCurve)-1] ^= 1
+	bad := map[string][]byte{
+		"short":     w.PublicKey[:wallet.PublicKeyLength-1],
+		"long":      append(bytes.Clone(w.PublicKey), 0),
+		"off curve": offCurve,
+		"infinity":  make([]byte, wallet.PublicKeyLength),
+	}
+	for name, key := range bad {
+		if _, err := parsePubKey(key); !errors.Is(err, ErrBadScript) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrBadScript)
+		}
+	}
+
+	// a key in the unpadded encoding used before keys were fixed-width no
+	// longer spends
+	short := shortKey(t, func(k *ecdsa.PublicKey) *big.Int { return k.X })
+	legacy := append(short.PrivateKey.X.Bytes(), short.PrivateKey.Y.Bytes()...)
+	prev := PayToPubKeyHash(wallet.PublicKeyHash(legacy))
+	tx := spendTx()
+	tx.Inputs[0].ScriptSig = PubKeyHashSig(sign(t, tx, short, prev), legacy)
+	if err := VerifyScript(tx, 0, prev, spentValue); !errors.Is(err, ErrBadScript) {
+		t.Errorf("unpadded key: err = %v, want %v", err, ErrBadScript)
+	}
+}
@@ -0,0 +1,37 @@
+package blockchain
+
+// Subsidy is the number of new coins a block at height may create.
+func Subsidy(height int) uint64 {
+	issued := Issued(height - 1)
+	if issued >= MaxSupply {
+		return 0
+	}
+	reward := scheduledSubsidy(height)
+	if issued+reward > MaxSupply {
+		reward = MaxSupply - issued
+	}
+	return reward
+}
+
+// Issued is the number of coins created by the blocks up to and including
+// height.
+func Issued(height int) uint64 {
+	var issued uint64
+	for start := 0; start <= height; start += HalvingInterval {
+		reward := scheduledSubsidy(start)
+		if reward == 0 {
+			break
+		}
+		blocks := min(height-start+1, HalvingInterval)
+		issued += reward * uint64(blocks)
+	}
+	return min(issued, MaxSupply)
+}
+
+func scheduledSubsidy(height int) uint64 {
+	halvings := height / HalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return InitialSubsidy >> halvings
+}
@@ -1,89 +1,218 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/big"
 	"strings"
 	"time"
 	"zeechain/wallet"
 )
 
+// Transaction cannot be mined before LockTime, a block height or a unix
+// time depending on LockTimeThreshold. Date is informational only.
 type Transaction struct {
-	Date    time.Time
-	ID      []byte
-	Inputs  []TransInput
-	Outputs []TransOutput
+	Date     time.Time
+	ID       []byte
+	Inputs   []TransInput
+	Outputs  []TransOutput
+	LockTime int64
 }
 
+// Hash is the transaction ID. Unlocking scripts are left out because the ID
+// is set before the inputs are signed, except for the coinbase whose
+// script carries the extra nonce.
 func (tx *Transaction) Hash() []byte {
-	tempId := tx.ID
-	tx.ID = []byte{}
-	hash := sha256.Sum256(tx.Serialize())
-	tx.ID = tempId
+	txCopy := *tx
+	txCopy.ID = []byte{}
+	if !tx.IsCoinbase() {
+		txCopy.Inputs = make([]TransInput, len(tx.Inputs))
+		for i, in := range tx.Inputs {
+			txCopy.Inputs[i] = TransInput{in.ID, in.OutId, nil, in.Sequence}
+		}
+	}
+	hash := sha256.Sum256(txCopy.Serialize())
 	return hash[:]
 }
 
-func (tx *Transaction) Serialize() []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(tx)
-	if err != nil {
-		log.Panic("Cannot serialize transaction")
-		return nil
+// encode writes the transaction in the canonical format. Date is kept to the
+// nanosecond so coinbases paying the same miner still get distinct IDs.
+func (tx *Transaction) encode(e *encoder) {
+	e.int64(tx.Date.UnixNano())
+	e.bytes(tx.ID)
+	e.uint32(uint32(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		e.bytes(in.ID)
+		e.int64(in.OutId)
+		e.bytes(in.ScriptSig)
+		e.uint32(in.Sequence)
+	}
+	e.uint32(uint32(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		out.encode(e)
 	}
-	return buf.Bytes()
+	e.int64(tx.LockTime)
 }
 
-func Deserialize(data io.Reader) *Transaction {
+func (tx *Transaction) decode(d *decoder) {
+	tx.Date = time.Unix(0, d.int64())
+	tx.ID = d.bytes()
+	n := d.length()
+	for i := 0; i < n && d.err == nil; i++ {
+		tx.Inputs = append(tx.Inputs, TransInput{
+			ID:        d.bytes(),
+			OutId:     d.int64(),
+			ScriptSig: d.bytes(),
+			Sequence:  d.uint32(),
+		})
+	}
+	n = d.length()
+	for i := 0; i < n && d.err == nil; i++ {
+		var out TransOutput
+		out.decode(d)
+		tx.Outputs = append(tx.Outputs, out)
+	}
+	tx.LockTime = d.int64()
+}
+
+func (tx *Transaction) Serialize() []byte {
+	e := newEncoder()
+	tx.encode(e)
+	return e.Bytes()
+}
+
+func DecodeTransaction(data []byte) (*Transaction, error) {
 	var trans Transaction
-	dec := gob.NewDecoder(data)
-	err := dec.Decode(&trans)
+	d := newDecoder(data)
+	trans.decode(d)
+	return &trans, d.finish()
+}
+
+func Deserialize(data io.Reader) *Transaction {
+	buf, err := io.ReadAll(data)
 	if err != nil {
-		log.Panicln("could not deserialize transactions")
-		return nil
+		log.Panicln("could not read transaction")
+	}
+	trans, err := DecodeTransaction(buf)
+	if err != nil {
+		log.Panicln("could not deserialize transactions:", err)
 	}
-	return &trans
+	return trans
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
-	var inputs []TransInput
-	var outputs []TransOutput
+// Payment is an amount sent to an address.
+type Payment struct {
+	Address string
+	Amount  int
+}
 
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	acc, valudOutputs := UTXO.FindSpendableOutput(pubKeyHash, amount)
-	if acc < amount {
-		log.Fatal("insufficient funds in wallet")
+// NewTransaction pays amount to the address and leaves fee for the miner,
+// the rest of the spent outputs comes back as change. The selector picks the
+// outputs to spend, LargestFirst when nil.
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO *UTXOSet, selector CoinSelector) (*Transaction, error) {
+	return NewBatchTransaction(w, []Payment{{to, amount}}, fee, UTXO, selector)
+}
+
+// NewBatchTransaction makes every payment in a single transaction, in order,
+// followed by one change output.
+func NewBatchTransaction(w *wallet.Wallet, payments []Payment, fee int, UTXO *UTXOSet, selector CoinSelector) (*Transaction, error) {
+	return NewMultiWalletTransaction([]*wallet.Wallet{w}, string(w.Address()), payments, fee, UTXO, selector)
+}
+
+// NewMultiWalletTransaction funds the payments from the coins of all the
+// wallets and sends the change to the change address. Each input is signed
+// by the wallet owning the output it spends.
+func NewMultiWalletTransaction(ws []*wallet.Wallet, change string, payments []Payment, fee int, UTXO *UTXOSet, selector CoinSelector) (*Transaction, error) {
+	if len(ws) == 0 {
+		return nil, errors.New("no wallets to spend from")
 	}
-	for tId, outs := range valudOutputs {
-		txId, err := hex.DecodeString(tId)
-		if err != nil {
-			log.Panic(err)
+	if len(payments) == 0 {
+		return nil, errors.New("no payments to make")
+	}
+	if fee < 0 {
+		return nil, errors.New("fee must not be negative")
+	}
+	if !wallet.ValidateAddress([]byte(change)) {
+		return nil, fmt.Errorf("change address %q is not valid", change)
+	}
+	var outputs []TransOutput
+	total := uint64(fee)
+	for i, p := range payments {
+		if !wallet.ValidateAddress([]byte(p.Address)) {
+			return nil, fmt.Errorf("payment %d: %q is not a valid address", i+1, p.Address)
 		}
-		for _, out := range outs {
-			inputs = append(inputs, TransInput{ID: txId, OutId: int64(out), Signature: nil, PubKey: w.PublicKey})
+		if p.Amount <= 0 {
+			return nil, fmt.Errorf("payment %d: amount must be positive", i+1)
 		}
+		outputs = append(outputs, *NewTransOutput(uint64(p.Amount), p.Address))
+		total += uint64(p.Amount)
 	}
-	outputs = append(outputs, *NewTransOutput(uint64(amount), to))
-	if acc > amount {
-		outputs = append(outputs, *NewTransOutput(uint64(acc-amount), string(w.Address())))
+	scripts := make([][]byte, len(ws))
+	keys := make([]*ecdsa.PrivateKey, len(ws))
+	for i, w := range ws {
+		scripts[i] = PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey))
+		keys[i] = &w.PrivateKey
+	}
+	coins, acc, err := UTXO.SelectCoinsFrom(scripts, total, selector)
+	if err != nil {
+		return nil, err
+	}
+	tx := Transaction{Date: time.Now(), Inputs: coinInputs(coins), Outputs: outputs}
+	if acc > total {
+		tx.Outputs = append(tx.Outputs, *NewTransOutput(acc-total, change))
 	}
-	tx := Transaction{time.Now(), nil, inputs, outputs}
 	tx.ID = tx.Hash()
-	UTXO.Chain.SignTransactions(&tx, &w.PrivateKey)
-	return &tx
+	if err := UTXO.Chain.SignTransactions(&tx, SigHashAll, keys...); err != nil {
+		return nil, err
+	}
+	return &tx, nil
 }
 
-func CoinBaseTx(to, data string) *Transaction {
+// NewDataTransaction anchors data in the chain with an unspendable output,
+// paying fee from the wallet with coins picked by selector, LargestFirst
+// when nil. The data output comes after the change so it does not shift the
+// change's position among the unspent outputs.
+func NewDataTransaction(w *wallet.Wallet, data []byte, fee int, UTXO *UTXOSet, selector CoinSelector) (*Transaction, error) {
+	script, err := DataScript(data)
+	if err != nil {
+		return nil, err
+	}
+	// spend at least one output even without a fee, a transaction needs an
+	// input
+	coins, acc, err := UTXO.SelectCoins(PayToPubKeyHash(wallet.PublicKeyHash(w.PublicKey)), uint64(max(fee, 1)), selector)
+	if err != nil {
+		return nil, err
+	}
+	tx := Transaction{Date: time.Now(), Inputs: coinInputs(coins)}
+	if acc > uint64(fee) {
+		tx.Outputs = append(tx.Outputs, *NewTransOutput(acc-uint64(fee), string(w.Address())))
+	}
+	tx.Outputs = append(tx.Outputs, TransOutput{0, script})
+	tx.ID = tx.Hash()
+	if err := UTXO.Chain.SignTransactions(&tx, SigHashAll, &w.PrivateKey); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// coinInputs spends the selected coins, unsigned.
+func coinInputs(coins []UTXOEntry) []TransInput {
+	inputs := make([]TransInput, len(coins))
+	for i, coin := range coins {
+		inputs[i] = TransInput{ID: coin.TxID, OutId: int64(coin.Index)}
+	}
+	return inputs
+}
+
+// CoinBaseTx pays the subsidy for a block at height plus the fees of the
+// block's other transactions to the miner. Its unlocking script starts with
+// a push of the height, so no two coinbases share an ID.
+func CoinBaseTx(to, data string, height int, fees uint64) *Transaction {
 	if data == "" {
 		randData := make([]byte, 24)
 		_, err := rand.Read(randData)
@@ -95,10 +224,9 @@ func CoinBaseTx(to, data string) *Transaction {
 	in := TransInput{
 		ID:        nil,
 		OutId:     -1,
-		Signature: nil,
-		PubKey:    []byte(data),
+		ScriptSig: append(ScriptPushInt(nil, int64(height)), data...),
 	}
-	out := NewTransOutput(10, to)
+	out := NewTransOutput(Subsidy(height)+fees, to)
 	trans := &Transaction{
 		Date:    time.Now(),
 		ID:      nil,
@@ -109,11 +237,31 @@ func CoinBaseTx(to, data string) *Transaction {
 	return trans
 }
 
+// setExtraNonce replaces the trailing extra nonce in the coinbase data so
+// the miner gets a fresh merkle root to search.
+func (tx *Transaction) setExtraNonce(extraNonce uint64) {
+	data := tx.Inputs[0].ScriptSig
+	if extraNonce > 1 {
+		data = data[:len(data)-8]
+	}
+	tx.Inputs[0].ScriptSig = append(data, ToHex(int64(extraNonce))...)
+	tx.ID = tx.Hash()
+}
+
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].OutId == -1
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]Transaction) error {
+// Sign fills in the unlocking scripts of inputs spending pay to public key
+// hash outputs of privKey, with signatures covering what hashType says.
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]Transaction, hashType SigHashType) error {
+	return tx.SignWithKeys([]ecdsa.PrivateKey{privKey}, prevTxs, hashType)
+}
+
+// SignWithKeys signs each input with whichever of the keys hashes to the
+// pubkey hash of the output it spends, so one transaction can spend from
+// several addresses.
+func (tx *Transaction) SignWithKeys(privKeys []ecdsa.PrivateKey, prevTxs map[string]Transaction, hashType SigHashType) error {
 	if tx.IsCoinbase() {
 		return nil
 	}
@@ -123,24 +271,34 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]Transac
 			return errors.New("previous transactions are void")
 		}
 	}
-	txCopy := tx.TrimmedCopy()
-	for inIdx, in := range txCopy.Inputs {
+	values := tx.spentValues(prevTxs)
+	keys := make(map[string]*ecdsa.PrivateKey)
+	for i := range privKeys {
+		pubKey := wallet.PublicKeyBytes(&privKeys[i].PublicKey)
+		keys[string(wallet.PublicKeyHash(pubKey))] = &privKeys[i]
+	}
+	for inIdx, in := range tx.Inputs {
 		prevTx := prevTxs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inIdx].Signature = nil
-		txCopy.Inputs[inIdx].PubKey = prevTx.Outputs[in.OutId].PubKeyHash
-
-		dataSign := txCopy.Serialize()
-		hash := sha256.Sum256(dataSign)
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash[:])
+		prevScript := prevTx.Outputs[in.OutId].ScriptPubKey
+		hash := ExtractPubKeyHash(prevScript)
+		if hash == nil {
+			return fmt.Errorf("cannot sign input %d: %s", inIdx, DisasmScript(prevScript))
+		}
+		privKey, ok := keys[string(hash)]
+		if !ok {
+			return fmt.Errorf("cannot sign input %d: no key for %x", inIdx, hash)
+		}
+		sig, err := tx.signInput(inIdx, privKey, prevScript, values, hashType)
 		if err != nil {
 			return err
 		}
-		tx.Inputs[inIdx].Signature = append(r.Bytes(), s.Bytes()...)
-		txCopy.Inputs[inIdx].PubKey = nil
+		pubKey := wallet.PublicKeyBytes(&privKey.PublicKey)
+		tx.Inputs[inIdx].ScriptSig = PubKeyHashSig(sig, pubKey)
 	}
 	return nil
 }
 
+// Verify runs the script of every input against the output it spends.
 func (tx *Transaction) Verify(prevTxs map[string]Transaction) (bool, error) {
 	if tx.IsCoinbase() {
 		return true, nil
@@ -151,41 +309,39 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) (bool, error) {
 			return false, errors.New("previous transactions are void")
 		}
 	}
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
+	values := tx.spentValues(prevTxs)
 	for inIdx, in := range tx.Inputs {
 		prevTx := prevTxs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inIdx].Signature = nil
-		txCopy.Inputs[inIdx].PubKey = prevTx.Outputs[in.OutId].PubKeyHash
-		r, s, x, y := big.Int{}, big.Int{}, big.Int{}, big.Int{}
-		sigLen := len(in.Signature)
-		keyLen := len(in.PubKey)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-		pubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		dataSign := txCopy.Serialize()
-		hash := sha256.Sum256(dataSign)
-		if !ecdsa.Verify(&pubKey, hash[:], &r, &s) {
-			return false, nil
+		if err := VerifyScript(tx, inIdx, prevTx.Outputs[in.OutId].ScriptPubKey, values); err != nil {
+			if errors.Is(err, ErrScriptFailed) {
+				return false, nil
+			}
+			return false, err
 		}
-		txCopy.Inputs[inIdx].PubKey = nil
 	}
 	return true, nil
 }
 
+// spentValues returns what the output spent by each input is worth.
+func (tx *Transaction) spentValues(prevTxs map[string]Transaction) []uint64 {
+	values := make([]uint64, len(tx.Inputs))
+	for inIdx, in := range tx.Inputs {
+		values[inIdx] = prevTxs[hex.EncodeToString(in.ID)].Outputs[in.OutId].Value
+	}
+	return values
+}
+
 func (tx *Transaction) TrimmedCopy() Transaction {
 	txInputs := make([]TransInput, 0, len(tx.Inputs))
 	txOutputs := make([]TransOutput, 0, len(tx.Outputs))
 
 	for _, in := range tx.Inputs {
-		txInputs = append(txInputs, TransInput{in.ID, in.OutId, nil, nil})
+		txInputs = append(txInputs, TransInput{in.ID, in.OutId, nil, in.Sequence})
 	}
 	for _, out := range tx.Outputs {
-		txOutputs = append(txOutputs, TransOutput{out.Value, out.PubKeyHash})
+		txOutputs = append(txOutputs, TransOutput{out.Value, out.ScriptPubKey})
 	}
-	return Transaction{tx.Date, tx.ID, txInputs, txOutputs}
+	return Transaction{tx.Date, tx.ID, txInputs, txOutputs, tx.LockTime}
 }
 
 func (tx Transaction) String() string {
@@ -193,18 +349,23 @@ func (tx Transaction) String() string {
 
 	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
 	lines = append(lines, fmt.Sprint(tx.Date))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     Lock time: %d", tx.LockTime))
+	}
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.OutId))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("       Script:    %s", DisasmScript(input.ScriptSig)))
+		if input.Sequence != 0 {
+			lines = append(lines, fmt.Sprintf("       Lock:      %s", sequenceString(input.Sequence)))
+		}
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", DisasmScript(output.ScriptPubKey)))
 	}
 
 	return strings.Join(lines, "\n")
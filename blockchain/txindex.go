@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"log"
+
+	"github.com/dgraph-io/badger"
+)
+
+var txIndexPrefix = []byte("txi-")
+
+// TxLocation is where a main chain transaction is stored: the block holding
+// it and its position among the block's transactions.
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+func (loc *TxLocation) Serialize() []byte {
+	e := newEncoder()
+	e.bytes(loc.BlockHash)
+	e.uint32(uint32(loc.Position))
+	return e.Bytes()
+}
+
+func DecodeTxLocation(data []byte) (*TxLocation, error) {
+	var loc TxLocation
+	d := newDecoder(data)
+	loc.BlockHash = d.bytes()
+	loc.Position = int(d.uint32())
+	return &loc, d.finish()
+}
+
+// indexTransactions records the location of the block's transactions. It
+// runs in the same badger transaction that connects the block.
+func indexTransactions(txn *badger.Txn, block *Block) error {
+	for i, tx := range block.Transactions {
+		loc := TxLocation{block.Hash, i}
+		if err := txn.Set(append(txIndexPrefix, tx.ID...), loc.Serialize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexTransactions forgets the block's transactions when it is
+// disconnected.
+func unindexTransactions(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if err := txn.Delete(append(txIndexPrefix, tx.ID...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTxLocation looks up a transaction of the main chain in the index.
+func (chain *Blockchain) GetTxLocation(id []byte) (*TxLocation, error) {
+	var loc *TxLocation
+	err := chain.Db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(txIndexPrefix, id...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			loc, err = DecodeTxLocation(val)
+			return err
+		})
+	})
+	return loc, err
+}
+
+// ReindexTransactions rebuilds the transaction index from the main chain.
+func (chain *Blockchain) ReindexTransactions() {
+	u := UTXOSet{chain}
+	u.DeleteByPrefix(txIndexPrefix)
+	iter := chain.Iterator()
+	for {
+		block := iter.Next()
+		err := chain.Db.Update(func(txn *badger.Txn) error {
+			return indexTransactions(txn, block)
+		})
+		if err != nil {
+			log.Panic(err)
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+}
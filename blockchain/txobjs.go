@@ -1,41 +1,54 @@
 package blockchain
 
 import (
-	"bytes"
-	"encoding/gob"
-	"log"
 	"zeechain/wallet"
 )
 
+// TransInput spends output OutId of transaction ID. ScriptSig is the
+// unlocking script, for the coinbase it holds arbitrary data instead.
+// Sequence is a relative lock on the spent output, see SequenceLockMask.
 type TransInput struct {
 	ID        []byte
 	OutId     int64
-	Signature []byte
-	PubKey    []byte
+	ScriptSig []byte
+	Sequence  uint32
 }
 
+// TransOutput is locked by ScriptPubKey, which the spending input's
+// unlocking script must satisfy.
 type TransOutput struct {
-	Value      uint64
-	PubKeyHash []byte
+	Value        uint64
+	ScriptPubKey []byte
 }
 
-type TransOutputs struct {
-	Outputs []TransOutput
+// UTXOEntry is an unspent output, output Index of transaction TxID, with the
+// height of the block that created it. TxID and Index make up its key in the
+// UTXO set and are not part of the serialized entry.
+type UTXOEntry struct {
+	TxID     []byte
+	Index    int
+	Output   TransOutput
+	Height   int
+	Coinbase bool
 }
 
-func (tx *TransInput) UsesKey(pubKeyHash []byte) bool {
-	inHash := wallet.PublicKeyHash(tx.PubKey)
-	return bytes.Equal(inHash, pubKeyHash)
+// IsMature reports whether the output can be spent in a block at height.
+// The genesis coinbase can never be reorganized away so it is always mature.
+func (entry *UTXOEntry) IsMature(height int) bool {
+	return !entry.Coinbase || entry.Height == 0 || height-entry.Height >= CoinbaseMaturity
 }
 
 func (tx *TransOutput) Lock(address []byte) {
-	pubKeyHash := wallet.DecodeBase58(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-wallet.ChecksumLength]
-	tx.PubKeyHash = pubKeyHash
+	tx.ScriptPubKey = AddressScript(address)
 }
 
-func (tx *TransOutput) IsLockedWIthKey(pubKeyHash []byte) bool {
-	return bytes.Equal(tx.PubKeyHash, pubKeyHash)
+// AddressScript is the locking script paying to address.
+func AddressScript(address []byte) []byte {
+	version, hash := wallet.DecodeAddress(address)
+	if version == wallet.ScriptVersion {
+		return PayToScriptHash(hash)
+	}
+	return PayToPubKeyHash(hash)
 }
 
 func NewTransOutput(value uint64, address string) *TransOutput {
@@ -44,24 +57,29 @@ func NewTransOutput(value uint64, address string) *TransOutput {
 	return out
 }
 
-func (txos TransOutputs) Serialize() []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&txos)
-	if err != nil {
-		log.Panicln("error in serialize")
-		return nil
-	}
-	return buf.Bytes()
+func (out *TransOutput) encode(e *encoder) {
+	e.uint64(out.Value)
+	e.bytes(out.ScriptPubKey)
 }
 
-func DeserialzeOutputs(data []byte) *TransOutputs {
-	var txos TransOutputs
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&txos)
-	if err != nil {
-		log.Panic("Cannot deserialize the trans outputs")
-		return nil
-	}
-	return &txos
+func (out *TransOutput) decode(d *decoder) {
+	out.Value = d.uint64()
+	out.ScriptPubKey = d.bytes()
+}
+
+func (entry *UTXOEntry) Serialize() []byte {
+	e := newEncoder()
+	entry.Output.encode(e)
+	e.int64(int64(entry.Height))
+	e.bool(entry.Coinbase)
+	return e.Bytes()
+}
+
+func DecodeUTXOEntry(txId []byte, index int, data []byte) (*UTXOEntry, error) {
+	entry := UTXOEntry{TxID: txId, Index: index}
+	d := newDecoder(data)
+	entry.Output.decode(d)
+	entry.Height = int(d.int64())
+	entry.Coinbase = d.bool()
+	return &entry, d.finish()
 }
@@ -2,74 +2,101 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/hex"
+	"encoding/binary"
+	"fmt"
 	"log"
 
 	"github.com/dgraph-io/badger"
 )
 
 var (
-	utxoPrefix   = []byte("utfo-")
-	prefixLength = len(utxoPrefix)
+	utxoPrefix = []byte("utxo-")
+	undoPrefix = []byte("undo-")
 )
 
 type UTXOSet struct {
 	Chain *Blockchain
 }
 
-func (u UTXOSet) FindSpendableOutput(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOut := make(map[string][]int)
-	accumulated := 0
-	db := u.Chain.Db
+// utxoKey is the key of output vout of transaction txId.
+func utxoKey(txId []byte, vout int) []byte {
+	key := append(append([]byte{}, utxoPrefix...), txId...)
+	return binary.BigEndian.AppendUint32(key, uint32(vout))
+}
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
+func decodeUTXOItem(item *badger.Item) (*UTXOEntry, error) {
+	key := bytes.TrimPrefix(item.Key(), utxoPrefix)
+	if len(key) < 4 {
+		return nil, fmt.Errorf("%w: UTXO key %x", ErrBadEncoding, item.Key())
+	}
+	txId := bytes.Clone(key[:len(key)-4])
+	vout := int(binary.BigEndian.Uint32(key[len(key)-4:]))
+	var entry *UTXOEntry
+	err := item.Value(func(val []byte) error {
+		var err error
+		entry, err = DecodeUTXOEntry(txId, vout, val)
+		return err
+	})
+	return entry, err
+}
+
+// forEach calls fn with every entry of the UTXO set, in key order.
+func (u UTXOSet) forEach(fn func(entry *UTXOEntry)) {
+	err := u.Chain.Db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var v []byte
-			err := item.Value(func(val []byte) error {
-				v = val
-				return nil
-			})
+			entry, err := decodeUTXOItem(it.Item())
 			if err != nil {
-				return nil
-			}
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txId := hex.EncodeToString(k)
-			log.Println(txId)
-			outs := DeserialzeOutputs(v)
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWIthKey(pubKeyHash) && accumulated < amount {
-					log.Printf("Amount: %d\n", out.Value)
-					accumulated += int(out.Value)
-					unspentOut[txId] = append(unspentOut[txId], outIdx)
-				}
+				return err
 			}
+			fn(entry)
 		}
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
-	return accumulated, unspentOut
 }
 
+// SelectCoins picks coins locked with script, mature at the next block,
+// worth at least target. A nil selector means LargestFirst.
+func (u UTXOSet) SelectCoins(script []byte, target uint64, selector CoinSelector) ([]UTXOEntry, uint64, error) {
+	return u.SelectCoinsFrom([][]byte{script}, target, selector)
+}
+
+// SelectCoinsFrom is SelectCoins choosing among the coins of several
+// scripts.
+func (u UTXOSet) SelectCoinsFrom(scripts [][]byte, target uint64, selector CoinSelector) ([]UTXOEntry, uint64, error) {
+	if selector == nil {
+		selector = LargestFirst{}
+	}
+	height := u.Chain.GetBestHeight() + 1
+	var coins []UTXOEntry
+	for _, script := range scripts {
+		for _, entry := range u.FindUnspentEntries(script) {
+			if entry.IsMature(height) {
+				coins = append(coins, entry)
+			}
+		}
+	}
+	picked, err := selector.Select(coins, target)
+	if err != nil {
+		return nil, 0, err
+	}
+	return picked, totalValue(picked), nil
+}
+
+// ReIndex rebuilds the UTXO set from the main chain.
 func (u UTXOSet) ReIndex() {
 	db := u.Chain.Db
 	u.DeleteByPrefix(utxoPrefix)
 	utxo := u.Chain.FindUTXO()
 	err := db.Update(func(txn *badger.Txn) error {
-		for txId, outs := range utxo {
-			key, err := hex.DecodeString(txId)
-			if err != nil {
+		for _, entry := range utxo {
+			if err := txn.Set(utxoKey(entry.TxID, entry.Index), entry.Serialize()); err != nil {
 				return err
 			}
-			key = append(utxoPrefix, key...)
-			err = txn.Set(key, outs.Serialize())
-			return err
 		}
 		return nil
 	})
@@ -78,105 +105,258 @@ func (u UTXOSet) ReIndex() {
 	}
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TransOutput {
+// FindUnspentScript returns the unspent outputs locked with script.
+func (u UTXOSet) FindUnspentScript(script []byte) []TransOutput {
 	var UTXOs []TransOutput
-	db := u.Chain.Db
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			var v []byte
-			err := item.Value(func(val []byte) error {
-				v = val
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-			outs := DeserialzeOutputs(v)
-			for _, out := range outs.Outputs {
-				if out.IsLockedWIthKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
-			}
+	for _, entry := range u.FindUnspentEntries(script) {
+		UTXOs = append(UTXOs, entry.Output)
+	}
+	return UTXOs
+}
+
+// FindUnspentEntries returns the UTXO entries locked with script.
+func (u UTXOSet) FindUnspentEntries(script []byte) []UTXOEntry {
+	var entries []UTXOEntry
+	u.forEach(func(entry *UTXOEntry) {
+		if bytes.Equal(entry.Output.ScriptPubKey, script) {
+			entries = append(entries, *entry)
 		}
-		return nil
+	})
+	return entries
+}
+
+// GetEntry returns output vout of transaction txId, or nil if it is spent
+// or does not exist.
+func (u UTXOSet) GetEntry(txId []byte, vout int) *UTXOEntry {
+	var entry *UTXOEntry
+	err := u.Chain.Db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoKey(txId, vout))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry, err = decodeUTXOItem(item)
+		return err
 	})
 	if err != nil {
 		log.Panic(err)
 	}
-	return UTXOs
+	return entry
 }
 
+// Supply is the total value of all unspent outputs.
+func (u UTXOSet) Supply() uint64 {
+	var supply uint64
+	u.forEach(func(entry *UTXOEntry) {
+		supply += entry.Output.Value
+	})
+	return supply
+}
+
+// CountTransactions counts the transactions with at least one unspent
+// output. Keys start with the transaction ID, so its outputs are adjacent.
 func (u UTXOSet) CountTransactions() int {
-	db := u.Chain.Db
 	counter := 0
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+	var last []byte
+	u.forEach(func(entry *UTXOEntry) {
+		if !bytes.Equal(entry.TxID, last) {
 			counter++
+			last = entry.TxID
 		}
-		return nil
 	})
-	if err != nil {
-		log.Panic(err)
-	}
 	return counter
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Chain.Db
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
-					inId := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inId)
-					if err != nil {
-						log.Panic(err)
-					}
-					var v []byte
-					err = item.Value(func(val []byte) error {
-						v = val
-						return nil
-					})
-					if err != nil {
-						return err
-					}
-					outs := DeserialzeOutputs(v)
-					updateOuts := TransOutputs{}
-					for outIdx, out := range outs.Outputs {
-						if outIdx != int(in.OutId) {
-							updateOuts.Outputs = append(updateOuts.Outputs, out)
-						}
-					}
-					if len(updateOuts.Outputs) == 0 {
-						if err := txn.Delete(inId); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inId, updateOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
-					}
+// BlockUndo holds the outputs a block spent, in the order its inputs spend
+// them, so the block can be disconnected again during a reorganization.
+type BlockUndo struct {
+	Spent []UTXOEntry
+}
+
+func (undo *BlockUndo) Serialize() []byte {
+	e := newEncoder()
+	e.uint32(uint32(len(undo.Spent)))
+	for _, entry := range undo.Spent {
+		e.bytes(entry.TxID)
+		e.int64(int64(entry.Index))
+		entry.Output.encode(e)
+		e.int64(int64(entry.Height))
+		e.bool(entry.Coinbase)
+	}
+	return e.Bytes()
+}
+
+func DecodeBlockUndo(data []byte) (*BlockUndo, error) {
+	var undo BlockUndo
+	d := newDecoder(data)
+	n := d.length()
+	for i := 0; i < n && d.err == nil; i++ {
+		entry := UTXOEntry{TxID: d.bytes(), Index: int(d.int64())}
+		entry.Output.decode(d)
+		entry.Height = int(d.int64())
+		entry.Coinbase = d.bool()
+		undo.Spent = append(undo.Spent, entry)
+	}
+	return &undo, d.finish()
+}
+
+// update removes the outputs the block spends and adds the spendable
+// outputs it creates.
+func (u *UTXOSet) update(txn *badger.Txn, block *Block) (*BlockUndo, error) {
+	undo := &BlockUndo{}
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				key := utxoKey(in.ID, int(in.OutId))
+				item, err := txn.Get(key)
+				if err == badger.ErrKeyNotFound {
+					return nil, fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.OutId)
 				}
-				newOutputs := TransOutputs{}
-				newOutputs.Outputs = append(newOutputs.Outputs, tx.Outputs...)
-				txId := append(utxoPrefix, tx.ID...)
-				if err := txn.Set(txId, newOutputs.Serialize()); err != nil {
-					log.Panic(err)
+				if err != nil {
+					return nil, err
+				}
+				entry, err := decodeUTXOItem(item)
+				if err != nil {
+					return nil, err
+				}
+				undo.Spent = append(undo.Spent, *entry)
+				if err := txn.Delete(key); err != nil {
+					return nil, err
 				}
 			}
 		}
-		return nil
+		for outIdx, out := range tx.Outputs {
+			if IsUnspendable(out.ScriptPubKey) {
+				continue
+			}
+			entry := UTXOEntry{Output: out, Height: block.Height, Coinbase: tx.IsCoinbase()}
+			if err := txn.Set(utxoKey(tx.ID, outIdx), entry.Serialize()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return undo, nil
+}
+
+// revert undoes update, going through the transactions backwards so an
+// output created and spent within the block ends up removed.
+func (u *UTXOSet) revert(txn *badger.Txn, block *Block, undo *BlockUndo) error {
+	spent := undo.Spent
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		for outIdx := range tx.Outputs {
+			if err := txn.Delete(utxoKey(tx.ID, outIdx)); err != nil {
+				return err
+			}
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		if len(spent) < len(tx.Inputs) {
+			return fmt.Errorf("undo data of block %x is short", block.Hash)
+		}
+		restore := spent[len(spent)-len(tx.Inputs):]
+		spent = spent[:len(spent)-len(tx.Inputs)]
+		for _, entry := range restore {
+			if err := txn.Set(utxoKey(entry.TxID, entry.Index), entry.Serialize()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// connectBlock spends the block's inputs and adds its outputs to the UTXO
+// set. The block must extend the current tip.
+func (u *UTXOSet) connectBlock(block *Block) error {
+	if err := u.Chain.checkInputs(block); err != nil {
+		return err
+	}
+	var addrEntries []addrEntry
+	if u.Chain.AddressIndexEnabled() {
+		var err error
+		if addrEntries, err = u.Chain.addressEntries(block); err != nil {
+			return err
+		}
+	}
+	err := u.Chain.Db.Update(func(txn *badger.Txn) error {
+		undo, err := u.update(txn, block)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(append(undoPrefix, block.Hash...), undo.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+			return err
+		}
+		if err := indexTransactions(txn, block); err != nil {
+			return err
+		}
+		for _, entry := range addrEntries {
+			if err := txn.Set(entry.key, entry.value); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte("lh"), block.Hash)
 	})
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	u.Chain.LastHash = block.Hash
+	return nil
+}
+
+// disconnectBlock restores the UTXO set to the state before the tip block
+// was connected.
+func (u *UTXOSet) disconnectBlock(block *Block) error {
+	var addrEntries []addrEntry
+	if u.Chain.AddressIndexEnabled() {
+		var err error
+		if addrEntries, err = u.Chain.addressEntries(block); err != nil {
+			return err
+		}
+	}
+	err := u.Chain.Db.Update(func(txn *badger.Txn) error {
+		undoKey := append(undoPrefix, block.Hash...)
+		item, err := txn.Get(undoKey)
+		if err != nil {
+			return err
+		}
+		var undo *BlockUndo
+		err = item.Value(func(val []byte) error {
+			undo, err = DecodeBlockUndo(val)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := u.revert(txn, block, undo); err != nil {
+			return err
+		}
+		if err := txn.Delete(undoKey); err != nil {
+			return err
+		}
+		if err := txn.Delete(heightKey(block.Height)); err != nil {
+			return err
+		}
+		if err := unindexTransactions(txn, block); err != nil {
+			return err
+		}
+		for _, entry := range addrEntries {
+			if err := txn.Delete(entry.key); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte("lh"), block.PrevHash)
+	})
+	if err != nil {
+		return err
 	}
+	u.Chain.LastHash = block.PrevHash
+	return nil
 }
 
 func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
@@ -0,0 +1,318 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+var (
+	ErrBadProofOfWork = errors.New("proof of work is invalid")
+	ErrOrphanBlock    = errors.New("parent block not found")
+	ErrInvalidChain   = errors.New("parent block is invalid")
+	ErrBadHeight      = errors.New("block height does not follow parent")
+	ErrBadDifficulty  = errors.New("block target does not match consensus")
+	ErrBadTimestamp   = errors.New("block timestamp is invalid")
+	ErrFutureBlock    = errors.New("block timestamp is too far in the future")
+	ErrNoTransactions = errors.New("block has no transactions")
+	ErrBlockTooLarge  = errors.New("block exceeds size limits")
+	ErrBadMerkleRoot  = errors.New("merkle root does not match transactions")
+	ErrBadCoinbase    = errors.New("invalid coinbase transaction")
+	ErrBadTransaction = errors.New("invalid transaction")
+	ErrBadSignature   = errors.New("invalid transaction signature")
+	ErrMissingInput   = errors.New("input refers to an unknown or spent output")
+	ErrDoubleSpend    = errors.New("output is spent more than once")
+	ErrImmatureSpend  = errors.New("coinbase output spent before maturity")
+	ErrTimeLocked     = errors.New("transaction is time locked")
+)
+
+// BlockError is returned when a block fails validation. Err is one of the
+// Err* values above, so callers can use errors.Is to decide how to react.
+type BlockError struct {
+	Hash   []byte
+	Err    error
+	Detail string
+}
+
+func (e *BlockError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("block %x: %v", e.Hash, e.Err)
+	}
+	return fmt.Sprintf("block %x: %v: %s", e.Hash, e.Err, e.Detail)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+func blockError(hash []byte, err error, format string, args ...any) *BlockError {
+	return &BlockError{hash, err, fmt.Sprintf(format, args...)}
+}
+
+// ValidateHeader checks a header against its parent, which must already be
+// in the block index.
+func (chain *Blockchain) ValidateHeader(h *BlockHeader, hash []byte) error {
+	if err := CheckHeader(h, hash); err != nil {
+		return err
+	}
+	parent, err := chain.GetBlockIndex(h.PrevHash)
+	if err != nil {
+		return blockError(hash, ErrOrphanBlock, "%x", h.PrevHash)
+	}
+	if parent.Invalid {
+		return blockError(hash, ErrInvalidChain, "%x", h.PrevHash)
+	}
+	if h.Height != parent.Height+1 {
+		return blockError(hash, ErrBadHeight, "got %d, parent is %d", h.Height, parent.Height)
+	}
+	mtp, err := chain.medianTime(parent)
+	if err != nil {
+		return err
+	}
+	if h.TimeStamp <= mtp {
+		return blockError(hash, ErrBadTimestamp, "%d is not after the median time past %d", h.TimeStamp, mtp)
+	}
+	bits, err := chain.NextBits(parent)
+	if err != nil {
+		return err
+	}
+	if h.Bits != bits {
+		return blockError(hash, ErrBadDifficulty, "got %08x, expected %08x", h.Bits, bits)
+	}
+	return nil
+}
+
+// ValidateBlock checks a block before it is stored. Inputs are checked
+// against the UTXO set when the block is connected to the main chain.
+func (chain *Blockchain) ValidateBlock(b *Block) error {
+	if err := CheckBlock(b); err != nil {
+		return err
+	}
+	if err := chain.ValidateHeader(&b.BlockHeader, b.Hash); err != nil {
+		return err
+	}
+	parent, err := chain.GetBlockIndex(b.PrevHash)
+	if err != nil {
+		return err
+	}
+	if parent.HeaderOnly {
+		return blockError(b.Hash, ErrOrphanBlock, "missing body of %x", b.PrevHash)
+	}
+	return nil
+}
+
+// CheckHeader runs the header checks that do not depend on the rest of the
+// chain.
+func CheckHeader(h *BlockHeader, hash []byte) error {
+	if !bytes.Equal(hash, h.Hash()) || !NewProof(h).Validate() {
+		return blockError(hash, ErrBadProofOfWork, "")
+	}
+	if h.TimeStamp > time.Now().Unix()+MaxFutureBlockTime {
+		return blockError(hash, ErrFutureBlock, "%d", h.TimeStamp)
+	}
+	return nil
+}
+
+// CheckBlock runs the checks that do not depend on the rest of the chain.
+func CheckBlock(b *Block) error {
+	if err := CheckHeader(&b.BlockHeader, b.Hash); err != nil {
+		return err
+	}
+	if len(b.Transactions) == 0 {
+		return blockError(b.Hash, ErrNoTransactions, "")
+	}
+	if len(b.Transactions) > MaxBlockTransactions {
+		return blockError(b.Hash, ErrBlockTooLarge, "%d transactions", len(b.Transactions))
+	}
+	if size := len(b.Serialize()); size > MaxBlockSize {
+		return blockError(b.Hash, ErrBlockTooLarge, "%d bytes", size)
+	}
+	if !bytes.Equal(b.MerkleRoot, b.HashTransactions()) {
+		return blockError(b.Hash, ErrBadMerkleRoot, "")
+	}
+	// the coinbase commits to the height so it cannot repeat an earlier one
+	// and overwrite its unspent output
+	if cb := b.Transactions[0]; cb.IsCoinbase() && !bytes.HasPrefix(cb.Inputs[0].ScriptSig, ScriptPushInt(nil, int64(b.Height))) {
+		return blockError(b.Hash, ErrBadCoinbase, "coinbase does not start with height %d", b.Height)
+	}
+	for i, tx := range b.Transactions {
+		if tx.IsCoinbase() != (i == 0) {
+			return blockError(b.Hash, ErrBadCoinbase, "coinbase must be the first and only coinbase")
+		}
+		if err := CheckTransaction(tx); err != nil {
+			return blockError(b.Hash, err, "tx %x", tx.ID)
+		}
+	}
+	return nil
+}
+
+func CheckTransaction(tx *Transaction) error {
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return ErrBadTransaction
+	}
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return ErrBadTransaction
+	}
+	var total uint64
+	for _, out := range tx.Outputs {
+		// no output, nor all of them together, may hold more coins than
+		// can ever exist
+		var ok bool
+		if total, ok = addValue(total, out.Value); !ok || total > MaxSupply {
+			return ErrBadTransaction
+		}
+		// unspendable outputs can only carry bounded data, and no value
+		// that would be burned with them
+		if IsUnspendable(out.ScriptPubKey) && (out.Value != 0 || ExtractData(out.ScriptPubKey) == nil) {
+			return ErrBadTransaction
+		}
+	}
+	return nil
+}
+
+// addValue adds two amounts of coins, reporting false instead of wrapping
+// around.
+func addValue(a, b uint64) (uint64, bool) {
+	sum, carry := bits.Add64(a, b, 0)
+	return sum, carry == 0
+}
+
+// TxError is returned when a transaction's inputs fail validation. Err is
+// one of the Err* values above.
+type TxError struct {
+	ID     []byte
+	Err    error
+	Detail string
+}
+
+func (e *TxError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("tx %x: %v", e.ID, e.Err)
+	}
+	return fmt.Sprintf("tx %x: %v: %s", e.ID, e.Err, e.Detail)
+}
+
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+func txError(id []byte, err error, format string, args ...any) *TxError {
+	return &TxError{id, err, fmt.Sprintf(format, args...)}
+}
+
+// CheckTransactionInputs checks tx as if it were mined in a block at height
+// and returns its fee. Inputs may spend the UTXO set or the outputs of the
+// unconfirmed transactions in pending, keyed by hex ID.
+func (chain *Blockchain) CheckTransactionInputs(tx *Transaction, height int, pending map[string]Transaction) (uint64, error) {
+	if tx.IsCoinbase() {
+		return 0, txError(tx.ID, ErrBadCoinbase, "coinbase outside a block")
+	}
+	return chain.checkTxInputs(tx, height, pending, make(map[string]bool))
+}
+
+// checkTxInputs adds the outpoints tx spends to spent, failing if one of
+// them is already there.
+func (chain *Blockchain) checkTxInputs(tx *Transaction, height int, pending map[string]Transaction, spent map[string]bool) (uint64, error) {
+	UTXO := UTXOSet{chain}
+	prevTxs := make(map[string]Transaction)
+	confirmed := make([]int, len(tx.Inputs))
+	var inValue, outValue uint64
+	for inIdx, in := range tx.Inputs {
+		outpoint := fmt.Sprintf("%x:%d", in.ID, in.OutId)
+		if spent[outpoint] {
+			return 0, txError(tx.ID, ErrDoubleSpend, "%s", outpoint)
+		}
+		spent[outpoint] = true
+
+		prevTx, isPending := pending[hex.EncodeToString(in.ID)]
+		if !isPending {
+			var err error
+			prevTx, err = chain.FindTransction(in.ID)
+			if err != nil {
+				return 0, txError(tx.ID, ErrMissingInput, "%s", outpoint)
+			}
+		}
+		if in.OutId < 0 || int(in.OutId) >= len(prevTx.Outputs) {
+			return 0, txError(tx.ID, ErrMissingInput, "%s", outpoint)
+		}
+		prevOut := prevTx.Outputs[in.OutId]
+		if isPending && prevTx.IsCoinbase() {
+			return 0, txError(tx.ID, ErrImmatureSpend, "%s", outpoint)
+		}
+		confirmed[inIdx] = height
+		if !isPending {
+			entry := UTXO.GetEntry(in.ID, int(in.OutId))
+			if entry == nil {
+				return 0, txError(tx.ID, ErrMissingInput, "%s", outpoint)
+			}
+			if !entry.IsMature(height) {
+				return 0, txError(tx.ID, ErrImmatureSpend, "%s", outpoint)
+			}
+			confirmed[inIdx] = entry.Height
+		}
+		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
+		var ok bool
+		if inValue, ok = addValue(inValue, prevOut.Value); !ok || inValue > MaxSupply {
+			return 0, txError(tx.ID, ErrBadTransaction, "inputs are worth more than the supply")
+		}
+	}
+	for _, out := range tx.Outputs {
+		var ok bool
+		if outValue, ok = addValue(outValue, out.Value); !ok || outValue > MaxSupply {
+			return 0, txError(tx.ID, ErrBadTransaction, "outputs are worth more than the supply")
+		}
+	}
+	if outValue > inValue {
+		return 0, txError(tx.ID, ErrBadTransaction, "spends %d of %d", outValue, inValue)
+	}
+	if err := chain.checkLocks(tx, height, confirmed); err != nil {
+		return 0, err
+	}
+	if ok, err := tx.Verify(prevTxs); err != nil || !ok {
+		return 0, txError(tx.ID, ErrBadSignature, "")
+	}
+	return inValue - outValue, nil
+}
+
+func (chain *Blockchain) checkInputs(b *Block) error {
+	spent := make(map[string]bool)
+	created := make(map[string]Transaction)
+	var fees uint64
+	for _, tx := range b.Transactions {
+		txId := hex.EncodeToString(tx.ID)
+		if tx.IsCoinbase() {
+			created[txId] = *tx
+			continue
+		}
+		fee, err := chain.checkTxInputs(tx, b.Height, created, spent)
+		if err != nil {
+			// anything but a TxError is a failure to read the chain, not a
+			// fault of the block
+			var txErr *TxError
+			if !errors.As(err, &txErr) {
+				return err
+			}
+			return blockError(b.Hash, txErr.Err, "tx %x: %s", tx.ID, txErr.Detail)
+		}
+		var ok bool
+		if fees, ok = addValue(fees, fee); !ok {
+			return blockError(b.Hash, ErrBadTransaction, "fees overflow")
+		}
+		created[txId] = *tx
+	}
+	var claimed uint64
+	for _, out := range b.Transactions[0].Outputs {
+		var ok bool
+		if claimed, ok = addValue(claimed, out.Value); !ok {
+			return blockError(b.Hash, ErrBadCoinbase, "claim overflows")
+		}
+	}
+	allowed, ok := addValue(Subsidy(b.Height), fees)
+	if !ok || claimed > allowed {
+		return blockError(b.Hash, ErrBadCoinbase, "claims %d, allowed %d", claimed, allowed)
+	}
+	return nil
+}
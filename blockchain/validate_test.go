@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+	"zeechain/wallet"
+)
+
+// newTestChain creates a chain in a temporary directory whose genesis
+// reward goes to the returned wallet.
+func newTestChain(t *testing.T) (*Blockchain, *wallet.Wallet) {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+	w := wallet.NewWallet()
+	chain := InitBlockChain(string(w.Address()), "test")
+	t.Cleanup(func() { chain.Db.Close() })
+	UTXOSet{chain}.ReIndex()
+	return chain, w
+}
+
+// spendGenesis signs a transaction spending the genesis reward into outputs
+// of the given values, all paid back to w.
+func spendGenesis(t *testing.T, chain *Blockchain, w *wallet.Wallet, values ...uint64) *Transaction {
+	t.Helper()
+	genesis, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &Transaction{Date: time.Now(), Inputs: []TransInput{{ID: genesis.Transactions[0].ID, OutId: 0}}}
+	for _, v := range values {
+		tx.Outputs = append(tx.Outputs, *NewTransOutput(v, string(w.Address())))
+	}
+	tx.ID = tx.Hash()
+	if err := chain.SignTransactions(tx, SigHashAll, &w.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestOutputValueOverflow(t *testing.T) {
+	chain, w := newTestChain(t)
+	tx := spendGenesis(t, chain, w, math.MaxUint64, 2)
+	if err := CheckTransaction(tx); !errors.Is(err, ErrBadTransaction) {
+		t.Errorf("CheckTransaction = %v, want %v", err, ErrBadTransaction)
+	}
+	if _, err := chain.CheckTransactionInputs(tx, 1, nil); !errors.Is(err, ErrBadTransaction) {
+		t.Errorf("CheckTransactionInputs = %v, want %v", err, ErrBadTransaction)
+	}
+	if _, err := chain.MineBlock(t.Context(), []*Transaction{CoinBaseTx(string(w.Address()), "", 1, 9), tx}); err == nil {
+		t.Error("mined a block creating coins through overflow")
+	}
+	if supply := (UTXOSet{chain}).Supply(); supply != Subsidy(0) {
+		t.Errorf("supply = %d, want %d", supply, Subsidy(0))
+	}
+}
+
+func TestTransactionAboveMaxSupply(t *testing.T) {
+	chain, w := newTestChain(t)
+	for _, values := range [][]uint64{{MaxSupply + 1}, {MaxSupply, 1}, {MaxSupply / 2, MaxSupply / 2, MaxSupply / 2}} {
+		tx := spendGenesis(t, chain, w, values...)
+		if err := CheckTransaction(tx); !errors.Is(err, ErrBadTransaction) {
+			t.Errorf("outputs %v: CheckTransaction = %v, want %v", values, err, ErrBadTransaction)
+		}
+		if _, err := chain.CheckTransactionInputs(tx, 1, nil); !errors.Is(err, ErrBadTransaction) {
+			t.Errorf("outputs %v: CheckTransactionInputs = %v, want %v", values, err, ErrBadTransaction)
+		}
+	}
+}
+
+func TestSpendWithinSupply(t *testing.T) {
+	chain, w := newTestChain(t)
+	tx := spendGenesis(t, chain, w, 4, 5)
+	if err := CheckTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	fee, err := chain.CheckTransactionInputs(tx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee != Subsidy(0)-9 {
+		t.Errorf("fee = %d, want %d", fee, Subsidy(0)-9)
+	}
+}
+
+func TestTimestampAfterMedianTimePast(t *testing.T) {
+	chain, _ := newTestChain(t)
+	tip, err := chain.GetBlockIndex(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtp, err := chain.MedianTimePast(tip.Height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.NextBits(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		timeStamp int64
+		ok        bool
+	}{{mtp - 1, false}, {mtp, false}, {mtp + 1, true}} {
+		h := BlockHeader{Version: BlockVersion, PrevHash: tip.Hash, MerkleRoot: make([]byte, 32), TimeStamp: test.timeStamp, Bits: bits, Height: 1}
+		nonce, hash, err := NewProof(&h).Run(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Nonce = nonce
+		err = chain.ValidateHeader(&h, hash)
+		if test.ok && err != nil || !test.ok && !errors.Is(err, ErrBadTimestamp) {
+			t.Errorf("timestamp %d with median time past %d: err = %v", test.timeStamp, mtp, err)
+		}
+	}
+}
+
+func TestGetBlockOnlyLoadsBlocks(t *testing.T) {
+	chain, _ := newTestChain(t)
+	for _, key := range []string{"lh", "dbversion", "bi-", "hdr-"} {
+		if _, err := chain.GetBlock([]byte(key)); err == nil {
+			t.Errorf("GetBlock(%q) found a block", key)
+		}
+	}
+	if _, err := chain.GetBlock(chain.LastHash); err != nil {
+		t.Errorf("GetBlock(tip) = %v", err)
+	}
+}
+
+func TestCoinbaseCommitsToHeight(t *testing.T) {
+	chain, w := newTestChain(t)
+	cb := CoinBaseTx(string(w.Address()), "x", 1, 0)
+	if _, err := chain.MineBlock(t.Context(), []*Transaction{cb}); err != nil {
+		t.Fatal(err)
+	}
+	// the same coinbase again would overwrite the unspent output of the first
+	if _, err := chain.MineBlock(t.Context(), []*Transaction{cb}); !errors.Is(err, ErrBadCoinbase) {
+		t.Errorf("repeated coinbase: err = %v, want %v", err, ErrBadCoinbase)
+	}
+	if _, err := chain.MineBlock(t.Context(), []*Transaction{CoinBaseTx(string(w.Address()), "x", 3, 0)}); !errors.Is(err, ErrBadCoinbase) {
+		t.Errorf("coinbase for another height: err = %v, want %v", err, ErrBadCoinbase)
+	}
+	if supply := (UTXOSet{chain}).Supply(); supply != Subsidy(0)+Subsidy(1) {
+		t.Errorf("supply = %d, want %d", supply, Subsidy(0)+Subsidy(1))
+	}
+}
@@ -35,6 +35,6 @@ require (
 )
 
 require (
-	github.com/btcsuite/btcutil v1.0.2 // indirect
+	github.com/btcsuite/btcutil v1.0.2
 	github.com/dgraph-io/badger v1.6.2
 )
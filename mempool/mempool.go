@@ -0,0 +1,487 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"zeechain/blockchain"
+)
+
+const (
+	// serialized bytes of transactions the pool holds before evicting
+	DefaultMaxSize = 1 << 20
+	// how long a transaction may wait to be mined before it is dropped
+	DefaultExpiry = 24 * time.Hour
+)
+
+var (
+	ErrKnownTx  = errors.New("transaction already in pool")
+	ErrConflict = errors.New("transaction spends an output another pool transaction spends")
+	ErrPoolFull = errors.New("pool is full and fee rate is too low")
+	// a replacement must pay more than everything it evicts
+	ErrReplacementFee = errors.New("replacement fee too low")
+)
+
+// Entry is a pool transaction with the fee it pays and when it arrived.
+type Entry struct {
+	Tx    *blockchain.Transaction
+	Fee   uint64
+	Size  int
+	Added time.Time
+}
+
+// FeeRate is the fee paid per serialized byte.
+func (e *Entry) FeeRate() float64 {
+	return float64(e.Fee) / float64(e.Size)
+}
+
+// Pool holds validated transactions waiting to be mined. Transactions spend
+// outputs of the UTXO set or of their unconfirmed parents in the pool, and
+// no two of them spend the same output.
+type Pool struct {
+	Chain   *blockchain.Blockchain
+	MaxSize int
+	Expiry  time.Duration
+
+	mu      sync.Mutex
+	path    string
+	entries map[string]*Entry
+	spends  map[string]string
+	size    int
+
+	// pool transactions spending outputs of each pool transaction
+	children map[string]map[string]*Entry
+}
+
+func New(chain *blockchain.Blockchain, nodeId string) *Pool {
+	return &Pool{
+		Chain:    chain,
+		MaxSize:  DefaultMaxSize,
+		Expiry:   DefaultExpiry,
+		path:     fmt.Sprintf("%s/mempool_%s.dat", os.TempDir(), nodeId),
+		entries:  make(map[string]*Entry),
+		spends:   make(map[string]string),
+		children: make(map[string]map[string]*Entry),
+	}
+}
+
+func outpoint(in blockchain.TransInput) string {
+	return fmt.Sprintf("%x:%d", in.ID, in.OutId)
+}
+
+// Add validates tx against the UTXO set and the rest of the pool and adds
+// it, evicting the lowest fee rate transactions if the pool is full.
+//
+// A transaction spending outputs already spent in the pool replaces the
+// conflicting transactions and their descendants if it pays a higher fee
+// than all of them together.
+func (p *Pool) Add(tx *blockchain.Transaction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.add(tx, time.Now(), true)
+}
+
+func (p *Pool) add(tx *blockchain.Transaction, added time.Time, replace bool) error {
+	p.expire(time.Now())
+	txId := hex.EncodeToString(tx.ID)
+	if _, ok := p.entries[txId]; ok {
+		return ErrKnownTx
+	}
+	if err := blockchain.CheckTransaction(tx); err != nil {
+		return err
+	}
+	replaced := make(map[string]*Entry)
+	for _, in := range tx.Inputs {
+		other, ok := p.spends[outpoint(in)]
+		if !ok {
+			continue
+		}
+		if !replace {
+			return fmt.Errorf("%w: %s spent by %s", ErrConflict, outpoint(in), other)
+		}
+		for _, e := range p.descendants(p.entries[other]) {
+			replaced[hex.EncodeToString(e.Tx.ID)] = e
+		}
+	}
+	pending := make(map[string]blockchain.Transaction)
+	for id, e := range p.entries {
+		if replaced[id] == nil {
+			pending[id] = *e.Tx
+		}
+	}
+	fee, err := p.Chain.CheckTransactionInputs(tx, p.Chain.GetBestHeight()+1, pending)
+	if err != nil {
+		return err
+	}
+	var replacedFee uint64
+	for _, e := range replaced {
+		replacedFee += e.Fee
+	}
+	if len(replaced) > 0 && fee <= replacedFee {
+		return fmt.Errorf("%w: pays %d, replaces %d", ErrReplacementFee, fee, replacedFee)
+	}
+	for _, e := range replaced {
+		log.Printf("mempool replaced %x with %x", e.Tx.ID, tx.ID)
+		p.remove(e)
+	}
+	e := &Entry{Tx: tx, Fee: fee, Size: len(tx.Serialize()), Added: added}
+	for p.size+e.Size > p.MaxSize && len(p.entries) > 0 {
+		worst, rate := p.evictionCandidate()
+		if rate >= e.FeeRate() {
+			return ErrPoolFull
+		}
+		for _, d := range p.descendants(worst) {
+			log.Printf("mempool full, evicting %x", d.Tx.ID)
+			p.remove(d)
+		}
+	}
+	p.entries[txId] = e
+	for _, in := range tx.Inputs {
+		p.spends[outpoint(in)] = txId
+	}
+	for _, parent := range p.parents(e) {
+		parentId := hex.EncodeToString(parent.Tx.ID)
+		if p.children[parentId] == nil {
+			p.children[parentId] = make(map[string]*Entry)
+		}
+		p.children[parentId][txId] = e
+	}
+	p.size += e.Size
+	return nil
+}
+
+func (p *Pool) remove(e *Entry) {
+	txId := hex.EncodeToString(e.Tx.ID)
+	if _, ok := p.entries[txId]; !ok {
+		return
+	}
+	delete(p.entries, txId)
+	for _, in := range e.Tx.Inputs {
+		delete(p.spends, outpoint(in))
+		if siblings := p.children[hex.EncodeToString(in.ID)]; siblings != nil {
+			delete(siblings, txId)
+		}
+	}
+	delete(p.children, txId)
+	p.size -= e.Size
+}
+
+// parents returns the pool transactions whose outputs e spends.
+func (p *Pool) parents(e *Entry) []*Entry {
+	var parents []*Entry
+	seen := make(map[string]bool)
+	for _, in := range e.Tx.Inputs {
+		id := hex.EncodeToString(in.ID)
+		if parent, ok := p.entries[id]; ok && !seen[id] {
+			seen[id] = true
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+// descendants returns e and every pool transaction that depends on it.
+func (p *Pool) descendants(e *Entry) []*Entry {
+	found := map[*Entry]bool{e: true}
+	result := []*Entry{e}
+	for i := 0; i < len(result); i++ {
+		for _, child := range p.children[hex.EncodeToString(result[i].Tx.ID)] {
+			if !found[child] {
+				found[child] = true
+				result = append(result, child)
+			}
+		}
+	}
+	return result
+}
+
+// evictionCandidate picks the transaction whose removal, together with its
+// descendants, loses the least fee per byte. A cheap parent is kept if a
+// child pays for it.
+func (p *Pool) evictionCandidate() (*Entry, float64) {
+	var worst *Entry
+	var worstRate float64
+	for _, e := range p.entries {
+		var fee uint64
+		var size int
+		for _, d := range p.descendants(e) {
+			fee += d.Fee
+			size += d.Size
+		}
+		rate := float64(fee) / float64(size)
+		if worst == nil || rate < worstRate {
+			worst, worstRate = e, rate
+		}
+	}
+	return worst, worstRate
+}
+
+// ordered returns the entries with parents before their children.
+func (p *Pool) ordered() []*Entry {
+	var result []*Entry
+	done := make(map[*Entry]bool)
+	var visit func(e *Entry)
+	visit = func(e *Entry) {
+		if done[e] {
+			return
+		}
+		done[e] = true
+		for _, parent := range p.parents(e) {
+			visit(parent)
+		}
+		result = append(result, e)
+	}
+	for _, e := range p.sorted() {
+		visit(e)
+	}
+	return result
+}
+
+// expire drops transactions that have waited longer than Expiry along with
+// their descendants.
+func (p *Pool) expire(now time.Time) {
+	for _, e := range p.entries {
+		if now.Sub(e.Added) > p.Expiry {
+			for _, d := range p.descendants(e) {
+				log.Printf("mempool expired %x", d.Tx.ID)
+				p.remove(d)
+			}
+		}
+	}
+}
+
+func (p *Pool) Get(id []byte) (*blockchain.Transaction, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[hex.EncodeToString(id)]
+	if !ok {
+		return nil, false
+	}
+	return e.Tx, true
+}
+
+func (p *Pool) Has(id []byte) bool {
+	_, ok := p.Get(id)
+	return ok
+}
+
+// Spends reports whether a pool transaction spends the output o.
+func (p *Pool) Spends(o blockchain.Outpoint) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.spends[o.String()]
+	return ok
+}
+
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+// Sorted returns the pool entries, highest fee rate first.
+func (p *Pool) Sorted() []*Entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(time.Now())
+	return p.sorted()
+}
+
+func (p *Pool) sorted() []*Entry {
+	entries := make([]*Entry, 0, len(p.entries))
+	for _, e := range p.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		ri, rj := entries[i].FeeRate(), entries[j].FeeRate()
+		if ri != rj {
+			return ri > rj
+		}
+		return entries[i].Added.Before(entries[j].Added)
+	})
+	return entries
+}
+
+// Package is a transaction together with the unconfirmed ancestors it
+// needs, parents first, so a child can pay for a cheap parent.
+type Package struct {
+	Entries []*Entry
+	Fee     uint64
+	Size    int
+}
+
+func (pkg *Package) FeeRate() float64 {
+	return float64(pkg.Fee) / float64(pkg.Size)
+}
+
+// SelectPackages orders the pool for mining, up to maxSize serialized bytes
+// and maxCount transactions. It repeatedly takes the transaction whose
+// package with its not yet taken ancestors pays the highest fee rate. A
+// package that does not fit is skipped and a smaller one tried in its place.
+func (p *Pool) SelectPackages(maxSize, maxCount int) []*Package {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire(time.Now())
+	entries := p.ordered()
+	pos := make(map[*Entry]int, len(entries))
+	candidates := make(map[*Entry]*candidate, len(entries))
+	for i, e := range entries {
+		pos[e] = i
+		c := &candidate{ancestors: map[*Entry]bool{e: true}}
+		for _, parent := range p.parents(e) {
+			for a := range candidates[parent].ancestors {
+				c.ancestors[a] = true
+			}
+		}
+		for a := range c.ancestors {
+			c.fee += a.Fee
+			c.size += a.Size
+		}
+		candidates[e] = c
+	}
+	var packages []*Package
+	size, count := 0, 0
+	for {
+		var best *Entry
+		for _, e := range entries {
+			c := candidates[e]
+			if c != nil && (best == nil || c.feeRate() > candidates[best].feeRate()) {
+				best = e
+			}
+		}
+		if best == nil {
+			return packages
+		}
+		c := candidates[best]
+		if size+c.size > maxSize || count+len(c.ancestors) > maxCount {
+			delete(candidates, best)
+			continue
+		}
+		pkg := &Package{Fee: c.fee, Size: c.size}
+		for a := range c.ancestors {
+			pkg.Entries = append(pkg.Entries, a)
+		}
+		sort.Slice(pkg.Entries, func(i, j int) bool {
+			return pos[pkg.Entries[i]] < pos[pkg.Entries[j]]
+		})
+		// what is taken no longer counts towards the packages of the
+		// transactions depending on it
+		for _, e := range pkg.Entries {
+			delete(candidates, e)
+			for _, d := range p.descendants(e)[1:] {
+				if dc := candidates[d]; dc != nil && dc.ancestors[e] {
+					delete(dc.ancestors, e)
+					dc.fee -= e.Fee
+					dc.size -= e.Size
+				}
+			}
+		}
+		size += pkg.Size
+		count += len(pkg.Entries)
+		packages = append(packages, pkg)
+	}
+}
+
+// candidate is the package a transaction would be mined in: itself and its
+// ancestors that are not taken yet.
+type candidate struct {
+	ancestors map[*Entry]bool
+	fee       uint64
+	size      int
+}
+
+func (c *candidate) feeRate() float64 {
+	return float64(c.fee) / float64(c.size)
+}
+
+// Revalidate checks every transaction again after the tip moved, dropping
+// those that were mined or now conflict with the chain. Children of mined
+// transactions stay, their parents' outputs are now in the UTXO set.
+//
+// The transactions of blocks a reorganization disconnected, tip first as
+// Blockchain.Disconnected returns them, are added back ahead of the pool's
+// own, unless the new branch mined them too.
+func (p *Pool) Revalidate(disconnected []*blockchain.Block) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries := p.ordered()
+	p.entries = make(map[string]*Entry)
+	p.spends = make(map[string]string)
+	p.children = make(map[string]map[string]*Entry)
+	p.size = 0
+	now := time.Now()
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, tx := range disconnected[i].Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			if err := p.add(tx, now, false); err != nil && !errors.Is(err, blockchain.ErrMissingInput) {
+				log.Printf("mempool dropped %x of a disconnected block: %v", tx.ID, err)
+			}
+		}
+	}
+	for _, e := range entries {
+		if err := p.add(e.Tx, e.Added, false); err != nil && !errors.Is(err, blockchain.ErrMissingInput) {
+			log.Printf("mempool dropped %x: %v", e.Tx.ID, err)
+		}
+	}
+}
+
+type savedEntry struct {
+	Tx    []byte
+	Added int64
+}
+
+// Save writes the pool to disk so it survives a restart.
+func (p *Pool) Save() error {
+	p.mu.Lock()
+	var saved []savedEntry
+	for _, e := range p.ordered() {
+		saved = append(saved, savedEntry{e.Tx.Serialize(), e.Added.Unix()})
+	}
+	p.mu.Unlock()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(saved); err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, buf.Bytes(), 0644)
+}
+
+// Load adds the transactions saved by Save. Those that were mined, expired
+// or became invalid while the node was down are dropped.
+func (p *Pool) Load() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+		return err
+	}
+	for _, s := range saved {
+		tx, err := blockchain.DecodeTransaction(s.Tx)
+		if err != nil {
+			return err
+		}
+		added := time.Unix(s.Added, 0)
+		if time.Since(added) > p.Expiry {
+			continue
+		}
+		if err := p.add(tx, added, false); err != nil {
+			log.Printf("dropping saved tx %x: %v", tx.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+	"zeechain/blockchain"
+	"zeechain/wallet"
+)
+
+// newTestPool creates a chain whose first block splits the genesis reward
+// into outputs worth 4, 3 and 3, all paid to the returned wallet, and an
+// empty pool on top of it.
+func newTestPool(t *testing.T) (*Pool, *wallet.Wallet, *blockchain.Transaction) {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+	w := wallet.NewWallet()
+	chain := blockchain.InitBlockChain(string(w.Address()), "test")
+	t.Cleanup(func() { chain.Db.Close() })
+	blockchain.UTXOSet{Chain: chain}.ReIndex()
+	genesis, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fund := spend(t, w, genesis.Transactions[0], 0, 4, 3, 3)
+	if _, err := chain.MineBlock(t.Context(), []*blockchain.Transaction{blockchain.CoinBaseTx(string(w.Address()), "", 1, 0), fund}); err != nil {
+		t.Fatal(err)
+	}
+	return New(chain, "test"), w, fund
+}
+
+// spend signs a transaction spending output out of prev into outputs of the
+// given values, paid back to w.
+func spend(t *testing.T, w *wallet.Wallet, prev *blockchain.Transaction, out int, values ...uint64) *blockchain.Transaction {
+	t.Helper()
+	tx := &blockchain.Transaction{Date: time.Now(), Inputs: []blockchain.TransInput{{ID: prev.ID, OutId: int64(out)}}}
+	for _, v := range values {
+		tx.Outputs = append(tx.Outputs, *blockchain.NewTransOutput(v, string(w.Address())))
+	}
+	tx.ID = tx.Hash()
+	if err := tx.Sign(w.PrivateKey, map[string]blockchain.Transaction{hex.EncodeToString(prev.ID): *prev}, blockchain.SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestReplaceByFee(t *testing.T) {
+	p, w, fund := newTestPool(t)
+	first := spend(t, w, fund, 0, 3)
+	if err := p.Add(first); err != nil {
+		t.Fatal(err)
+	}
+
+	sameFee := spend(t, w, fund, 0, 2, 1)
+	if err := p.Add(sameFee); !errors.Is(err, ErrReplacementFee) {
+		t.Errorf("equal fee: err = %v, want %v", err, ErrReplacementFee)
+	}
+	if !p.Has(first.ID) || p.Has(sameFee.ID) {
+		t.Error("equal fee replaced the original")
+	}
+
+	higher := spend(t, w, fund, 0, 2)
+	if err := p.Add(higher); err != nil {
+		t.Fatal(err)
+	}
+	if p.Has(first.ID) || !p.Has(higher.ID) || p.Len() != 1 {
+		t.Error("higher fee did not replace the original")
+	}
+}
+
+func TestReplaceEvictsDescendants(t *testing.T) {
+	p, w, fund := newTestPool(t)
+	parent := spend(t, w, fund, 0, 3)
+	child := spend(t, w, parent, 0, 2)
+	for _, tx := range []*blockchain.Transaction{parent, child} {
+		if err := p.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the replacement has to outbid the child too
+	if err := p.Add(spend(t, w, fund, 0, 2)); !errors.Is(err, ErrReplacementFee) {
+		t.Errorf("outbidding only the parent: err = %v, want %v", err, ErrReplacementFee)
+	}
+	replacement := spend(t, w, fund, 0, 1)
+	if err := p.Add(replacement); err != nil {
+		t.Fatal(err)
+	}
+	if p.Has(parent.ID) || p.Has(child.ID) || p.Len() != 1 {
+		t.Error("replaced transaction or its child still in the pool")
+	}
+	if len(p.children) != 0 {
+		t.Errorf("children of evicted transactions still tracked: %v", p.children)
+	}
+}
+
+// ids lists the transactions of each package.
+func ids(packages []*Package) [][]string {
+	var all [][]string
+	for _, pkg := range packages {
+		var txs []string
+		for _, e := range pkg.Entries {
+			txs = append(txs, hex.EncodeToString(e.Tx.ID))
+		}
+		all = append(all, txs)
+	}
+	return all
+}
+
+func TestSelectPackages(t *testing.T) {
+	p, w, fund := newTestPool(t)
+	// the parent pays nothing, its child pays 3 and a single 1, so the pair
+	// beats the single only when taken together
+	parent := spend(t, w, fund, 0, 4)
+	child := spend(t, w, parent, 0, 1)
+	single := spend(t, w, fund, 1, 2)
+	for _, tx := range []*blockchain.Transaction{parent, child, single} {
+		if err := p.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pair := []string{hex.EncodeToString(parent.ID), hex.EncodeToString(child.ID)}
+	alone := []string{hex.EncodeToString(single.ID)}
+
+	tests := []struct {
+		name     string
+		maxCount int
+		want     [][]string
+	}{
+		{"child pays for parent", 3, [][]string{pair, alone}},
+		// the pair does not fit, the single is taken in its place
+		{"pair too large", 1, [][]string{alone}},
+		{"single too large after pair", 2, [][]string{pair}},
+	}
+	for _, test := range tests {
+		if got := ids(p.SelectPackages(1<<20, test.maxCount)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: packages %v, want %v", test.name, got, test.want)
+		}
+	}
+}
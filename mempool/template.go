@@ -0,0 +1,64 @@
+package mempool
+
+import (
+	"zeechain/blockchain"
+)
+
+// extraNonceSize is the room left in the coinbase for the extra nonce
+// CreateBlock adds when the nonce space runs out.
+const extraNonceSize = 8
+
+// Template is a block to be mined on PrevHash: a coinbase paying the miner
+// followed by pool transactions, parents before children. Its timestamp
+// must be at least MinTime.
+type Template struct {
+	PrevHash     []byte
+	Height       int
+	Bits         uint32
+	MinTime      int64
+	Transactions []*blockchain.Transaction
+	Fees         uint64
+	Size         int
+}
+
+// NewTemplate builds a block on the current tip from the pool, taking the
+// best paying packages that fit in MaxBlockSize and MaxBlockTransactions.
+func (p *Pool) NewTemplate(minerAddress string) (*Template, error) {
+	tip, err := p.Chain.GetBlockIndex(p.Chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+	bits, err := p.Chain.NextBits(tip)
+	if err != nil {
+		return nil, err
+	}
+	mtp, err := p.Chain.MedianTimePast(tip.Height)
+	if err != nil {
+		return nil, err
+	}
+	t := &Template{PrevHash: tip.Hash, Height: tip.Height + 1, Bits: bits, MinTime: mtp + 1}
+
+	// the coinbase encodes to the same size whatever fee it claims
+	empty := blockchain.Block{
+		BlockHeader: blockchain.BlockHeader{
+			Version:    blockchain.BlockVersion,
+			PrevHash:   tip.Hash,
+			MerkleRoot: make([]byte, len(tip.Hash)),
+		},
+		Hash:         make([]byte, len(tip.Hash)),
+		Transactions: []*blockchain.Transaction{blockchain.CoinBaseTx(minerAddress, "", t.Height, 0)},
+	}
+	t.Size = len(empty.Serialize()) + extraNonceSize
+
+	var txs []*blockchain.Transaction
+	for _, pkg := range p.SelectPackages(blockchain.MaxBlockSize-t.Size, blockchain.MaxBlockTransactions-1) {
+		for _, e := range pkg.Entries {
+			txs = append(txs, e.Tx)
+		}
+		t.Fees += pkg.Fee
+		t.Size += pkg.Size
+	}
+	coinbase := blockchain.CoinBaseTx(minerAddress, "", t.Height, t.Fees)
+	t.Transactions = append([]*blockchain.Transaction{coinbase}, txs...)
+	return t, nil
+}
@@ -1,13 +1,23 @@
 package node
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 	"zeechain/blockchain"
+	"zeechain/mempool"
 	"zeechain/wallet"
 )
 
@@ -18,12 +28,26 @@ func (cli *CommandLine) Usage() {
 	fmt.Println(" getbalance -address ADDRESS - get the balance for an address")
 	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println(" send -from FROM[,FROM...] -to TO -amount AMOUNT -fee FEE [-change ADDRESS] [-select STRATEGY] [-coins TXID:INDEX,...] [-replace TXID] -mine - Send amount of coins, leaving FEE for the miner. Then -mine flag is set, mine off of this node")
+	fmt.Println("   -select picks the outputs to spend: largest (default), bnb for an exact match without change, random, or dust to sweep up small outputs. -coins spends exactly the listed outputs. -replace spends the outputs of our unmined transaction TXID again, replacing it if FEE is higher. Several FROM addresses of our wallet fund the transaction together, each signing its own inputs")
+	fmt.Println(" sendmany -from FROM[,FROM...] -file FILE -fee FEE [-change ADDRESS] [-select STRATEGY] [-coins TXID:INDEX,...] [-replace TXID] -mine - Pays every address,amount line of a CSV FILE, or the address/amount objects of a .json FILE, in one transaction with a single change output")
 	fmt.Println(" createwallet - Creates a new Wallet")
 	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" reindextx - Rebuilds the index used to look transactions up by ID")
+	fmt.Println(" indexaddresses - Builds the address index and keeps it up to date from then on")
+	fmt.Println(" history -address ADDRESS [-skip N] [-limit N] - Lists the transactions of an address, newest first. Needs the address index")
+	fmt.Println(" supply - Reports the circulating supply from the UTXO set")
+	fmt.Println(" startnode -miner ADDRESS -interval SECONDS - Start a node with ID specified in NODE_ID env. var. -miner enables mining when transactions arrive, -interval also mines every SECONDS")
 	fmt.Println(" loadchain - loads a blockchain given by NODE_ADDR")
+	fmt.Println(" getpubkey -address ADDRESS - Prints the public key of an address in our wallet")
+	fmt.Println(" createmultisig -m M -pubkeys KEY,KEY,... - Creates an address spendable with M of the public keys")
+	fmt.Println(" createtx -from FROM -to TO -amount AMOUNT -fee FEE [-redeem SCRIPT] [-locktime LOCKTIME] [-after BLOCKS | -afterseconds SECONDS] [-select STRATEGY] [-coins TXID:INDEX,...] -out FILE - Writes an unsigned transaction, with the outputs it spends, for offline signing. -redeem is needed to spend from a multisig address")
+	fmt.Println("   -locktime is the first block height, or unix time, the transaction can be mined at. -after waits that many blocks after the spent outputs were mined, -afterseconds that many seconds of median time past")
+	fmt.Println(" signtx -in FILE -key KEYFILE [-sighash TYPE] - Signs the transaction in FILE with a .wal key, without a chain")
+	fmt.Println("   -sighash is ALL (default), NONE to leave the outputs open or SINGLE to cover only the output matching each input, with |ANYONECANPAY to let others add inputs")
+	fmt.Println(" broadcasttx -in FILE - Checks the signed transaction in FILE and sends it")
+	fmt.Println(" anchor -from FROM -data HEX -fee FEE - Sends a transaction recording up to 80 bytes of data, such as a document hash, in the chain")
 
 }
 
@@ -34,7 +58,7 @@ func (cli *CommandLine) validateArgs() {
 	}
 }
 
-func (cli *CommandLine) StartNode(nodeID, nodeAddr, minerAddress string) {
+func (cli *CommandLine) StartNode(nodeID, nodeAddr, minerAddress string, mineInterval time.Duration) {
 	fmt.Printf("Starting Node %s\n", nodeID)
 
 	if len(minerAddress) > 0 {
@@ -44,7 +68,7 @@ func (cli *CommandLine) StartNode(nodeID, nodeAddr, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	StartServer(nodeAddr, nodeID, minerAddress)
+	StartServer(nodeAddr, nodeID, minerAddress, mineInterval)
 }
 
 func (cli *CommandLine) reindexUTXO(nodeID string) {
@@ -57,6 +81,54 @@ func (cli *CommandLine) reindexUTXO(nodeID string) {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
+func (cli *CommandLine) reindexTx(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Db.Close()
+	chain.ReindexTransactions()
+	fmt.Println("Done! Rebuilt the transaction index.")
+}
+
+func (cli *CommandLine) indexAddresses(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Db.Close()
+	if err := chain.EnableAddressIndex(); err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("Done! The address index is enabled.")
+}
+
+func (cli *CommandLine) history(address string, skip, limit int, nodeID string) {
+	if !wallet.ValidateAddress([]byte(address)) {
+		log.Panic("Address is not Valid")
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Db.Close()
+	count, balance, err := chain.AddressSummary([]byte(address))
+	if err != nil {
+		log.Panic(err)
+	}
+	history, err := chain.AddressHistory([]byte(address), skip, limit)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("%s: %d transactions, balance %d\n", address, count, balance)
+	for _, atx := range history {
+		fmt.Printf("%8d %x %+d\n", atx.Height, atx.TxID, atx.Delta)
+	}
+}
+
+func (cli *CommandLine) supply(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Db.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	height := chain.GetBestHeight()
+
+	fmt.Printf("Circulating supply: %d\n", UTXOSet.Supply())
+	fmt.Printf("Issued by height %d: %d\n", height, blockchain.Issued(height))
+	fmt.Printf("Next block subsidy: %d\n", blockchain.Subsidy(height+1))
+	fmt.Printf("Max supply: %d\n", blockchain.MaxSupply)
+}
+
 func (cli *CommandLine) listAddresses(nodeID string) {
 	wallets, err := wallet.CreateWallets(nodeID)
 	if err != nil {
@@ -90,7 +162,7 @@ func (cli *CommandLine) printChain(nodeID string) {
 
 		fmt.Printf("Hash: %x\n", block.Hash)
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
-		pow := blockchain.NewProof(block)
+		pow := blockchain.NewProof(&block.BlockHeader)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
@@ -123,22 +195,99 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	UTXOSet := blockchain.UTXOSet{Chain: chain}
 	defer chain.Db.Close()
+	if _, balance, err := chain.AddressSummary([]byte(address)); err == nil {
+		fmt.Printf("Balance of %s: %d\n", address, balance)
+		return
+	}
 	balance := 0
-	pubKeyHash := wallet.DecodeBase58([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	UTXOs := UTXOSet.FindUnspentScript(blockchain.AddressScript([]byte(address)))
 	for _, out := range UTXOs {
 		balance += int(out.Value)
 	}
 	fmt.Printf("Balance of %s: %d\n", address, balance)
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
+// coinSelector spends the listed outpoints when there are any, otherwise it
+// uses the named strategy.
+func coinSelector(strategy, coins string) blockchain.CoinSelector {
+	if coins == "" {
+		selector, err := blockchain.NewCoinSelector(strategy)
+		if err != nil {
+			log.Panic(err)
+		}
+		return selector
+	}
+	var manual blockchain.ManualSelect
+	for _, c := range strings.Split(coins, ",") {
+		o, err := blockchain.ParseOutpoint(strings.TrimSpace(c))
+		if err != nil {
+			log.Panic(err)
+		}
+		manual.Outpoints = append(manual.Outpoints, o)
+	}
+	return manual
+}
+
+func (cli *CommandLine) send(from, change, to string, amount, fee int, selector blockchain.CoinSelector, replace, nodeID string, mineNow bool) {
 	if !wallet.ValidateAddress([]byte(to)) {
 		log.Panic("to Address is not Valid")
 	}
-	if !wallet.ValidateAddress([]byte(from)) {
-		log.Panic("from Address is not Valid")
+	cli.sendPayments(from, change, []blockchain.Payment{{Address: to, Amount: amount}}, fee, selector, replace, nodeID, mineNow)
+}
+
+// readPayments loads address and amount pairs from a JSON file, an array of
+// {"address": ..., "amount": ...} objects, or from CSV lines of
+// address,amount with an optional header.
+func readPayments(file string) []blockchain.Payment {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	var payments []blockchain.Payment
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		if err := json.Unmarshal(data, &payments); err != nil {
+			log.Panic(err)
+		}
+		return payments
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		log.Panic(err)
+	}
+	for i, record := range records {
+		if len(record) != 2 {
+			log.Panicf("%s line %d: want address,amount", file, i+1)
+		}
+		amount, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			log.Panicf("%s line %d: %v", file, i+1, err)
+		}
+		payments = append(payments, blockchain.Payment{Address: strings.TrimSpace(record[0]), Amount: amount})
+	}
+	return payments
+}
+
+func (cli *CommandLine) sendMany(from, change, file string, fee int, selector blockchain.CoinSelector, replace, nodeID string, mineNow bool) {
+	cli.sendPayments(from, change, readPayments(file), fee, selector, replace, nodeID, mineNow)
+}
+
+// sendPayments spends from the comma separated from addresses, all of which
+// must be in our wallet. Change goes to the first of them unless change is
+// set. When replace names one of our unmined transactions, its outputs are
+// spent again so the new transaction replaces it.
+func (cli *CommandLine) sendPayments(from, change string, payments []blockchain.Payment, fee int, selector blockchain.CoinSelector, replace, nodeID string, mineNow bool) {
+	addresses := strings.Split(from, ",")
+	for i, address := range addresses {
+		addresses[i] = strings.TrimSpace(address)
+		if !wallet.ValidateAddress([]byte(addresses[i])) {
+			log.Panic("from Address is not Valid")
+		}
+	}
+	if change == "" {
+		change = addresses[0]
 	}
 	chain := blockchain.ContinueBlockChain(nodeID)
 	UTXOSet := blockchain.UTXOSet{Chain: chain}
@@ -148,24 +297,228 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
+	var senders []*wallet.Wallet
+	for _, address := range addresses {
+		w, ok := wallets.Wallets[address]
+		if !ok {
+			log.Panicf("%s is not in the wallet", address)
+		}
+		senders = append(senders, w)
+	}
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	pool := pendingPool(chain, nodeID)
+	spent := pool.Spends
+	if replace != "" {
+		id, err := hex.DecodeString(replace)
+		if err != nil {
+			log.Panic(err)
+		}
+		old, ok := pool.Get(id)
+		if !ok {
+			log.Panicf("%s is not an unmined transaction", replace)
+		}
+		var reused blockchain.ManualSelect
+		for _, in := range old.Inputs {
+			reused.Outpoints = append(reused.Outpoints, blockchain.Outpoint{ID: in.ID, Index: int(in.OutId)})
+		}
+		selector = reused
+		spent = func(o blockchain.Outpoint) bool {
+			return pool.Spends(o) && !slices.ContainsFunc(reused.Outpoints, func(r blockchain.Outpoint) bool {
+				return r.Index == o.Index && bytes.Equal(r.ID, o.ID)
+			})
+		}
+	}
+	selector = blockchain.SkipSpent{Selector: selector, Spent: spent}
+	tx, err := blockchain.NewMultiWalletTransaction(senders, change, payments, fee, &UTXOSet, selector)
+	if err != nil {
+		log.Panic(err)
+	}
 	if mineNow {
-		cbTx := blockchain.CoinBaseTx(from, "")
+		cbTx := blockchain.CoinBaseTx(addresses[0], "", chain.GetBestHeight()+1, uint64(fee))
 		txs := []*blockchain.Transaction{cbTx, tx}
-		block, err := chain.MineBlock(txs)
+		_, err := chain.MineBlock(context.Background(), txs)
 		if err != nil {
 			log.Panic(err)
 		}
-		UTXOSet.Update(block)
 	} else {
+		keepPending(pool, tx)
 		SendTx(KnownNodeAddress[0], tx)
-		fmt.Println("send tx")
+		fmt.Printf("send tx %x\n", tx.ID)
 	}
 	fmt.Println("Success!")
 }
 
+// pendingPool loads the saved pool, where our earlier transactions wait
+// until they are mined. Their coins must not be picked again.
+func pendingPool(chain *blockchain.Blockchain, nodeID string) *mempool.Pool {
+	pool := mempool.New(chain, nodeID)
+	if err := pool.Load(); err != nil {
+		log.Panic(err)
+	}
+	return pool
+}
+
+// keepPending records tx in the saved pool, so later commands leave its
+// coins alone.
+func keepPending(pool *mempool.Pool, tx *blockchain.Transaction) {
+	if err := pool.Add(tx); err != nil {
+		log.Panic(err)
+	}
+	if err := pool.Save(); err != nil {
+		log.Panic(err)
+	}
+}
+
+func (cli *CommandLine) anchor(from, dataHex string, fee int, nodeID string) {
+	if !wallet.ValidateAddress([]byte(from)) {
+		log.Panic("from Address is not Valid")
+	}
+	data, err := hex.DecodeString(dataHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	defer chain.Db.Close()
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w, ok := wallets.Wallets[from]
+	if !ok {
+		log.Panicf("%s is not in the wallet", from)
+	}
+
+	pool := pendingPool(chain, nodeID)
+	tx, err := blockchain.NewDataTransaction(w, data, fee, &UTXOSet, blockchain.SkipSpent{Spent: pool.Spends})
+	if err != nil {
+		log.Panic(err)
+	}
+	keepPending(pool, tx)
+	SendTx(KnownNodeAddress[0], tx)
+	fmt.Printf("Anchored in %x\n", tx.ID)
+}
+
+func (cli *CommandLine) getPubKey(address, nodeID string) {
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panicf("%s is not in the wallet", address)
+	}
+	fmt.Printf("Public key of %s: %x\n", address, w.PublicKey)
+}
+
+func (cli *CommandLine) createMultisig(m int, pubKeys string) {
+	var keys [][]byte
+	for _, k := range strings.Split(pubKeys, ",") {
+		key, err := hex.DecodeString(strings.TrimSpace(k))
+		if err != nil {
+			log.Panic(err)
+		}
+		keys = append(keys, key)
+	}
+	redeem, err := blockchain.MultisigScript(m, keys)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Address: %s\n", blockchain.MultisigAddress(redeem))
+	fmt.Printf("Redeem script: %x\n", redeem)
+}
+
+func readPartialTx(file string) *blockchain.PartialTx {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	ptx, err := blockchain.DeserializePartialTx(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return ptx
+}
+
+func writePartialTx(file string, ptx *blockchain.PartialTx) {
+	if err := os.WriteFile(file, ptx.Serialize(), 0644); err != nil {
+		log.Panic(err)
+	}
+	ready, inputs := ptx.Signed()
+	fmt.Printf("Wrote %s, %d of %d inputs signed\n", file, ready, inputs)
+}
+
+func (cli *CommandLine) createTx(from, to string, redeemHex string, amount, fee int, lockTime int64, sequence uint32, selector blockchain.CoinSelector, out, nodeID string) {
+	if !wallet.ValidateAddress([]byte(to)) {
+		log.Panic("to Address is not Valid")
+	}
+	if !wallet.ValidateAddress([]byte(from)) {
+		log.Panic("from Address is not Valid")
+	}
+	redeem, err := hex.DecodeString(redeemHex)
+	if err != nil {
+		log.Panic(err)
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Db.Close()
+	UTXOSet := blockchain.UTXOSet{Chain: chain}
+	selector = blockchain.SkipSpent{Selector: selector, Spent: pendingPool(chain, nodeID).Spends}
+	ptx, err := blockchain.CreatePartialTx(from, to, redeem, amount, fee, &UTXOSet, selector)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := ptx.SetLocks(lockTime, sequence); err != nil {
+		log.Panic(err)
+	}
+	writePartialTx(out, ptx)
+}
+
+// signTx signs with a single .wal key file so it can run on a machine that
+// has neither the chain nor the rest of the wallet.
+func (cli *CommandLine) signTx(file, keyFile, sigHash string) {
+	hashType, err := blockchain.ParseSigHashType(sigHash)
+	if err != nil {
+		log.Panic(err)
+	}
+	var w wallet.Wallet
+	if err := w.Load(keyFile); err != nil {
+		log.Panic(err)
+	}
+	ptx := readPartialTx(file)
+	fee, err := ptx.Fee()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(ptx.Tx)
+	fmt.Printf("Fee: %d\n", fee)
+	n, err := ptx.Sign(w.PrivateKey, hashType)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Signed %d inputs with %s, SIGHASH_%s\n", n, w.Address(), hashType)
+	writePartialTx(file, ptx)
+}
+
+func (cli *CommandLine) broadcastTx(file, nodeID string) {
+	tx, err := readPartialTx(file).Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Db.Close()
+	if err := blockchain.CheckTransaction(tx); err != nil {
+		log.Panic(err)
+	}
+	fee, err := chain.CheckTransactionInputs(tx, chain.GetBestHeight()+1, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	keepPending(pendingPool(chain, nodeID), tx)
+	SendTx(KnownNodeAddress[0], tx)
+	fmt.Printf("Sent %x paying %d in fees\n", tx.ID, fee)
+}
+
 func (cli *CommandLine) LoadChain(nodeID string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer chain.Db.Close()
@@ -192,20 +545,69 @@ func (cli *CommandLine) Run() {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	sendManyCmd := flag.NewFlagSet("sendmany", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	indexAddressesCmd := flag.NewFlagSet("indexaddresses", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 	loadChain := flag.NewFlagSet("loadchain", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	createTxCmd := flag.NewFlagSet("createtx", flag.ExitOnError)
+	signTxCmd := flag.NewFlagSet("signtx", flag.ExitOnError)
+	broadcastTxCmd := flag.NewFlagSet("broadcasttx", flag.ExitOnError)
+	anchorCmd := flag.NewFlagSet("anchor", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
-	sendFrom := sendCmd.String("from", "", "Source wallet address")
+	sendFrom := sendCmd.String("from", "", "Source wallet address, or comma separated addresses to spend from together")
+	sendChange := sendCmd.String("change", "", "Address receiving the change, the first source by default")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee left for the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendSelect := sendCmd.String("select", "largest", "Coin selection: largest, bnb, random or dust")
+	sendCoins := sendCmd.String("coins", "", "Comma separated TXID:INDEX outputs to spend")
+	sendReplace := sendCmd.String("replace", "", "Unmined transaction to replace by spending its outputs")
+	sendManyFrom := sendManyCmd.String("from", "", "Source wallet address, or comma separated addresses to spend from together")
+	sendManyChange := sendManyCmd.String("change", "", "Address receiving the change, the first source by default")
+	sendManyFile := sendManyCmd.String("file", "", "CSV or .json file of addresses and amounts to pay")
+	sendManyFee := sendManyCmd.Int("fee", 0, "Fee left for the miner")
+	sendManyMine := sendManyCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendManySelect := sendManyCmd.String("select", "largest", "Coin selection: largest, bnb, random or dust")
+	sendManyCoins := sendManyCmd.String("coins", "", "Comma separated TXID:INDEX outputs to spend")
+	sendManyReplace := sendManyCmd.String("replace", "", "Unmined transaction to replace by spending its outputs")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeInterval := startNodeCmd.Int("interval", 0, "Also mine a block every SECONDS, even without transactions")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "The wallet address to print the public key of")
+	createMultisigM := createMultisigCmd.Int("m", 0, "Signatures required to spend")
+	createMultisigKeys := createMultisigCmd.String("pubkeys", "", "Comma separated hex public keys")
+	createTxFrom := createTxCmd.String("from", "", "Source address")
+	createTxTo := createTxCmd.String("to", "", "Destination wallet address")
+	createTxAmount := createTxCmd.Int("amount", 0, "Amount to send")
+	createTxFee := createTxCmd.Int("fee", 0, "Fee left for the miner")
+	createTxRedeem := createTxCmd.String("redeem", "", "Hex redeem script printed by createmultisig")
+	createTxLockTime := createTxCmd.Int64("locktime", 0, "Block height or unix time the transaction is locked until")
+	createTxAfter := createTxCmd.Int("after", 0, "Blocks the spent outputs must be buried under")
+	createTxAfterSeconds := createTxCmd.Int64("afterseconds", 0, "Seconds that must pass after the spent outputs were mined, rounded up to 512")
+	createTxSelect := createTxCmd.String("select", "largest", "Coin selection: largest, bnb, random or dust")
+	createTxCoins := createTxCmd.String("coins", "", "Comma separated TXID:INDEX outputs to spend")
+	createTxOut := createTxCmd.String("out", "", "File to write the unsigned transaction to")
+	signTxIn := signTxCmd.String("in", "", "Transaction file to sign")
+	signTxKey := signTxCmd.String("key", "", "The .wal key file to sign with")
+	signTxSigHash := signTxCmd.String("sighash", "ALL", "What the signatures cover: ALL, NONE or SINGLE, optionally |ANYONECANPAY")
+	broadcastTxIn := broadcastTxCmd.String("in", "", "Signed transaction file")
+	anchorFrom := anchorCmd.String("from", "", "Wallet address paying the fee")
+	anchorData := anchorCmd.String("data", "", "Hex data to record")
+	anchorFee := anchorCmd.Int("fee", 0, "Fee left for the miner")
+	historyAddress := historyCmd.String("address", "", "The address to list transactions of")
+	historySkip := historyCmd.Int("skip", 0, "Newest transactions to skip")
+	historyLimit := historyCmd.Int("limit", 20, "Most transactions to list")
 
 	switch os.Args[1] {
 	case "reindexutxo":
@@ -213,6 +615,26 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "reindextx":
+		err := reindexTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "indexaddresses":
+		err := indexAddressesCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "history":
+		err := historyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "supply":
+		err := supplyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -248,11 +670,46 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "sendmany":
+		err := sendManyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "loadchain":
 		err := loadChain.Parse(os.Args[:2])
 		if err != nil {
 			log.Fatal(err)
 		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createtx":
+		err := createTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signtx":
+		err := signTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "broadcasttx":
+		err := broadcastTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "anchor":
+		err := anchorCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.Usage()
 		runtime.Goexit()
@@ -287,14 +744,38 @@ func (cli *CommandLine) Run() {
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
+	if reindexTxCmd.Parsed() {
+		cli.reindexTx(nodeID)
+	}
+	if indexAddressesCmd.Parsed() {
+		cli.indexAddresses(nodeID)
+	}
+	if historyCmd.Parsed() {
+		if *historyAddress == "" || *historySkip < 0 || *historyLimit <= 0 {
+			historyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.history(*historyAddress, *historySkip, *historyLimit, nodeID)
+	}
+	if supplyCmd.Parsed() {
+		cli.supply(nodeID)
+	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendReplace != "" && *sendCoins != "" {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendChange, *sendTo, *sendAmount, *sendFee, coinSelector(*sendSelect, *sendCoins), *sendReplace, nodeID, *sendMine)
+	}
+
+	if sendManyCmd.Parsed() {
+		if *sendManyFrom == "" || *sendManyFile == "" || *sendManyFee < 0 || *sendManyReplace != "" && *sendManyCoins != "" {
+			sendManyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.sendMany(*sendManyFrom, *sendManyChange, *sendManyFile, *sendManyFee, coinSelector(*sendManySelect, *sendManyCoins), *sendManyReplace, nodeID, *sendManyMine)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -303,9 +784,58 @@ func (cli *CommandLine) Run() {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.StartNode(nodeID, nodeAddr, *startNodeMiner)
+		cli.StartNode(nodeID, nodeAddr, *startNodeMiner, time.Duration(*startNodeInterval)*time.Second)
 	}
 	if loadChain.Parsed() {
 		cli.LoadChain(nodeID)
 	}
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getPubKey(*getPubKeyAddress, nodeID)
+	}
+	if createMultisigCmd.Parsed() {
+		if *createMultisigM <= 0 || *createMultisigKeys == "" {
+			createMultisigCmd.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*createMultisigM, *createMultisigKeys)
+	}
+	if createTxCmd.Parsed() {
+		if *createTxFrom == "" || *createTxTo == "" || *createTxAmount <= 0 || *createTxFee < 0 || *createTxOut == "" ||
+			*createTxLockTime < 0 || *createTxAfter < 0 || *createTxAfter > blockchain.SequenceLockMask ||
+			*createTxAfterSeconds < 0 || *createTxAfterSeconds > blockchain.MaxRelativeLockSeconds ||
+			*createTxAfter > 0 && *createTxAfterSeconds > 0 {
+			createTxCmd.Usage()
+			os.Exit(1)
+		}
+		sequence := blockchain.RelativeLock(*createTxAfter)
+		if *createTxAfterSeconds > 0 {
+			sequence = blockchain.RelativeTimeLock(*createTxAfterSeconds)
+		}
+		cli.createTx(*createTxFrom, *createTxTo, *createTxRedeem, *createTxAmount, *createTxFee, *createTxLockTime, sequence, coinSelector(*createTxSelect, *createTxCoins), *createTxOut, nodeID)
+	}
+	if signTxCmd.Parsed() {
+		if *signTxIn == "" || *signTxKey == "" {
+			signTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.signTx(*signTxIn, *signTxKey, *signTxSigHash)
+	}
+	if broadcastTxCmd.Parsed() {
+		if *broadcastTxIn == "" {
+			broadcastTxCmd.Usage()
+			os.Exit(1)
+		}
+		cli.broadcastTx(*broadcastTxIn, nodeID)
+	}
+	if anchorCmd.Parsed() {
+		if *anchorFrom == "" || *anchorData == "" || *anchorFee < 0 {
+			anchorCmd.Usage()
+			os.Exit(1)
+		}
+		cli.anchor(*anchorFrom, *anchorData, *anchorFee, nodeID)
+	}
 }
@@ -3,18 +3,22 @@ package node
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"zeechain/blockchain"
+	"zeechain/mempool"
 
 	"github.com/vrecan/death"
 )
@@ -23,6 +27,7 @@ const (
 	protocol      = "tcp"
 	version       = 1
 	commandLength = 12
+	banThreshold  = 100
 )
 
 var (
@@ -30,7 +35,12 @@ var (
 	mineAddress      string
 	KnownNodeAddress []string
 	blocksInTransit  = [][]byte{}
-	memoryPool       = make(map[string]blockchain.Transaction)
+	memoryPool       *mempool.Pool
+	stopMining       context.CancelFunc
+	newTxEvents      = make(chan struct{}, 1)
+	miningMutex      sync.Mutex
+	misbehavior      = make(map[string]int)
+	misbehaviorMutex sync.Mutex
 	bufferPool       = sync.Pool{
 		New: func() any {
 			return new(bytes.Buffer)
@@ -51,6 +61,16 @@ type GetBlocks struct {
 	AddrFrom string
 }
 
+type GetHeaders struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+type Headers struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
 type GetData struct {
 	AddrFrom string
 	Type     string
@@ -154,6 +174,59 @@ func LoadKnownNodes() error {
 	return nil
 }
 
+// Misbehaving adds score to a peer's misbehavior count and drops the known
+// nodes on that host once it reaches banThreshold. host is the address the
+// connection came from, not one the peer claims in a message.
+func Misbehaving(host string, score int) {
+	if score == 0 {
+		return
+	}
+	misbehaviorMutex.Lock()
+	defer misbehaviorMutex.Unlock()
+	misbehavior[host] += score
+	if misbehavior[host] < banThreshold {
+		return
+	}
+	log.Printf("banning peer %s", host)
+	kept := KnownNodeAddress[:0]
+	for _, node := range KnownNodeAddress {
+		if !onHost(node, host) {
+			kept = append(kept, node)
+		}
+	}
+	KnownNodeAddress = kept
+}
+
+func IsBanned(host string) bool {
+	misbehaviorMutex.Lock()
+	defer misbehaviorMutex.Unlock()
+	return misbehavior[host] >= banThreshold
+}
+
+// onHost reports whether the node address resolves to host.
+func onHost(node, host string) bool {
+	name, _, err := net.SplitHostPort(node)
+	if err != nil {
+		return false
+	}
+	addrs, err := net.LookupHost(name)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(addrs, host)
+}
+
+// rejectScore is how much a rejected block or header counts against the
+// peer that sent it. A missing parent is fetched instead, and a timestamp in
+// the future may only mean our clock is behind, so neither is held against
+// the peer.
+func rejectScore(err error) int {
+	if errors.Is(err, blockchain.ErrOrphanBlock) || errors.Is(err, blockchain.ErrFutureBlock) {
+		return 0
+	}
+	return banThreshold
+}
+
 func SendData(addr string, data []byte) {
 	conn, err := net.Dial(protocol, addr)
 	if err != nil {
@@ -203,6 +276,22 @@ func SendGetBlocks(addr string) {
 	request := append(CommandToByte("getblocks"), payload...)
 	SendData(addr, request)
 }
+func SendGetHeaders(addr string, locator [][]byte) {
+	payload := GobEncode(GetHeaders{AddrFrom: nodeAddress, Locator: locator})
+	request := append(CommandToByte("getheaders"), payload...)
+	SendData(addr, request)
+}
+
+func SendHeaders(addr string, headers []blockchain.BlockHeader) {
+	var items [][]byte
+	for _, h := range headers {
+		items = append(items, h.Serialize())
+	}
+	payload := GobEncode(Headers{AddrFrom: nodeAddress, Headers: items})
+	request := append(CommandToByte("headers"), payload...)
+	SendData(addr, request)
+}
+
 func SendGetData(address, kind string, id []byte) {
 	payload := GobEncode(GetData{AddrFrom: nodeAddress, Type: kind, Id: id})
 	request := append(CommandToByte("getdata"), payload...)
@@ -241,26 +330,96 @@ func HandleAddr(req *bytes.Buffer) {
 	RequestBlocks()
 }
 
-func Handleblocks(req *bytes.Buffer, chain *blockchain.Blockchain) {
+func Handleblocks(req *bytes.Buffer, chain *blockchain.Blockchain, peer string) {
 	var payload Block
 	dec := gob.NewDecoder(req)
 	err := dec.Decode(&payload)
 	if err != nil {
 		log.Panic(err)
 	}
-	block := blockchain.DeserializeBlock(bytes.NewReader(payload.Block))
+	block, err := blockchain.DecodeBlock(payload.Block)
+	if err != nil {
+		log.Printf("malformed block from %s: %v", peer, err)
+		Misbehaving(peer, banThreshold)
+		return
+	}
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
-	fmt.Printf("Added block: %s\n", block.Hash)
+	oldTip := chain.LastHash
+	if err := chain.AddBlock(block); err != nil {
+		log.Printf("rejected block from %s: %v", peer, err)
+		blocksInTransit = blocksInTransit[:0]
+		if errors.Is(err, blockchain.ErrOrphanBlock) {
+			SendGetHeaders(payload.AddrFrom, chain.Locator())
+		}
+		Misbehaving(peer, rejectScore(err))
+		return
+	}
+	fmt.Printf("Added block: %x\n", block.Hash)
+	if !bytes.Equal(oldTip, chain.LastHash) {
+		AbortMining()
+		disconnected, err := chain.Disconnected(oldTip)
+		if err != nil {
+			log.Panic(err)
+		}
+		memoryPool.Revalidate(disconnected)
+	}
 
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		SendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[:1]
-	} else {
-		utxoSet := blockchain.UTXOSet{Chain: chain}
-		utxoSet.ReIndex()
+		blocksInTransit = blocksInTransit[1:]
+	}
+}
+
+func HandleGetHeaders(req *bytes.Buffer, chain *blockchain.Blockchain) {
+	var payload GetHeaders
+	dec := gob.NewDecoder(req)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
 	}
+	SendHeaders(payload.AddrFrom, chain.HeadersAfter(payload.Locator, blockchain.MaxHeaders))
+}
+
+// HandleHeaders validates and indexes the headers, then fetches the bodies
+// we are missing in chain order.
+func HandleHeaders(req *bytes.Buffer, chain *blockchain.Blockchain, peer string) {
+	var payload Headers
+	dec := gob.NewDecoder(req)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Recevied %d headers\n", len(payload.Headers))
+	blocksInTransit = blocksInTransit[:0]
+	var lastHash []byte
+	for _, data := range payload.Headers {
+		header, err := blockchain.DecodeHeader(data)
+		if err != nil {
+			log.Printf("malformed header from %s: %v", peer, err)
+			Misbehaving(peer, banThreshold)
+			return
+		}
+		if err := chain.AddHeader(header); err != nil {
+			log.Printf("rejected header from %s: %v", peer, err)
+			Misbehaving(peer, rejectScore(err))
+			break
+		}
+		hash := header.Hash()
+		lastHash = hash
+		if bi, err := chain.GetBlockIndex(hash); err == nil && bi.HeaderOnly {
+			blocksInTransit = append(blocksInTransit, hash)
+		}
+	}
+	if len(payload.Headers) == blockchain.MaxHeaders {
+		SendGetHeaders(payload.AddrFrom, append([][]byte{lastHash}, chain.Locator()...))
+	}
+	if len(blocksInTransit) == 0 {
+		return
+	}
+	blockHash := blocksInTransit[0]
+	blocksInTransit = blocksInTransit[1:]
+	SendGetData(payload.AddrFrom, "block", blockHash)
 }
 
 func HandleGetData(req *bytes.Buffer, chain *blockchain.Blockchain) {
@@ -279,9 +438,9 @@ func HandleGetData(req *bytes.Buffer, chain *blockchain.Blockchain) {
 		}
 		SendBlock(payload.AddrFrom, &block)
 	case "tx":
-		txId := hex.EncodeToString(payload.Id)
-		tx := memoryPool[txId]
-		SendTx(payload.AddrFrom, &tx)
+		if tx, ok := memoryPool.Get(payload.Id); ok {
+			SendTx(payload.AddrFrom, tx)
+		}
 	}
 }
 
@@ -295,22 +454,22 @@ func HandleInv(req *bytes.Buffer, chain *blockchain.Blockchain) {
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 	switch payload.Type {
 	case "block":
-		blocksInTransit = payload.Items
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
-		for i, b := range blocksInTransit {
-			if bytes.Equal(b, blockHash) {
-				if i+1 < len(blocksInTransit) {
-					blocksInTransit = append(blocksInTransit[:i], blocksInTransit[i+1:]...)
-				} else {
-					blocksInTransit = blocksInTransit[:len(blocksInTransit)-1]
-				}
-				break
+		// inventories list the tip first, blocks are requested parent first
+		blocksInTransit = blocksInTransit[:0]
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if _, err := chain.GetBlock(payload.Items[i]); err != nil {
+				blocksInTransit = append(blocksInTransit, payload.Items[i])
 			}
 		}
+		if len(blocksInTransit) == 0 {
+			return
+		}
+		blockHash := blocksInTransit[0]
+		blocksInTransit = blocksInTransit[1:]
+		SendGetData(payload.AddrFrom, "block", blockHash)
 	case "tx":
 		txId := payload.Items[0]
-		if memoryPool[hex.EncodeToString(txId)].ID == nil {
+		if !memoryPool.Has(txId) {
 			SendGetData(payload.AddrFrom, "tx", txId)
 		}
 	}
@@ -327,16 +486,24 @@ func HandleGetBlocks(req *bytes.Buffer, chain *blockchain.Blockchain) {
 	SendInv(payload.AddrFrom, "block", blocks)
 }
 
-func HandleTx(req *bytes.Buffer, chain *blockchain.Blockchain) {
+func HandleTx(req *bytes.Buffer, chain *blockchain.Blockchain, peer string) {
 	var payload Tx
 	dec := gob.NewDecoder(req)
 	err := dec.Decode(&payload)
 	if err != nil {
 		log.Panic(err)
 	}
-	tx := blockchain.Deserialize(bytes.NewReader(payload.Transaction))
-	memoryPool[hex.EncodeToString(tx.ID)] = *tx
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	tx, err := blockchain.DecodeTransaction(payload.Transaction)
+	if err != nil {
+		log.Printf("malformed tx from %s: %v", peer, err)
+		Misbehaving(peer, banThreshold)
+		return
+	}
+	if err := memoryPool.Add(tx); err != nil {
+		log.Printf("rejected tx %x from %s: %v", tx.ID, payload.AddrFrom, err)
+		return
+	}
+	fmt.Printf("%s, %d\n", nodeAddress, memoryPool.Len())
 	if nodeAddress == KnownNodeAddress[0] {
 		for _, node := range KnownNodeAddress[1:] {
 			if node != payload.AddrFrom {
@@ -344,41 +511,82 @@ func HandleTx(req *bytes.Buffer, chain *blockchain.Blockchain) {
 			}
 		}
 	} else {
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
-			MineTx(chain)
+		if len(mineAddress) > 0 {
+			NotifyMiner()
 		}
 	}
 }
 
+// AbortMining stops the block being mined, used when a new tip arrives and
+// the work would be stale.
+func AbortMining() {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	if stopMining != nil {
+		stopMining()
+	}
+}
+
+// MineTx mines a block template built from the memory pool on the current
+// tip and announces the block to our peers.
 func MineTx(chain *blockchain.Blockchain) {
-	var txs []*blockchain.Transaction
-	for _, tx := range memoryPool {
-		if chain.VerifyTransactions(&tx) {
-			txs = append(txs, &tx)
-		}
+	tmpl, err := memoryPool.NewTemplate(mineAddress)
+	if err != nil {
+		log.Panic(err)
 	}
-	if len(txs) == 0 {
-		log.Println("All transactions are invalid")
+	log.Printf("mining block %d with %d transactions, %d bytes, %d in fees",
+		tmpl.Height, len(tmpl.Transactions)-1, tmpl.Size, tmpl.Fees)
+	ctx, cancel := context.WithCancel(context.Background())
+	miningMutex.Lock()
+	stopMining = cancel
+	miningMutex.Unlock()
+	newBlock, err := blockchain.CreateBlock(ctx, tmpl.Transactions, tmpl.PrevHash, tmpl.Height, tmpl.Bits, tmpl.MinTime)
+	cancel()
+	if errors.Is(err, context.Canceled) {
+		log.Println("mining aborted, a new block arrived")
+		return
 	}
-	cbTx := blockchain.CoinBaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
-	newBlock, err := chain.MineBlock(txs)
 	if err != nil {
 		log.Panic(err)
 	}
-	UTXOSet := blockchain.UTXOSet{Chain: chain}
-	UTXOSet.ReIndex()
-	for _, tx := range memoryPool {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+	if err := chain.AddBlock(newBlock); err != nil {
+		log.Printf("mined block rejected: %v", err)
+		return
 	}
+	memoryPool.Revalidate(nil)
 	for _, node := range KnownNodeAddress {
 		if node != nodeAddress {
 			SendInv(node, "block", [][]byte{newBlock.Hash})
 		}
 	}
+}
 
-	if len(memoryPool) > 0 {
+// NotifyMiner wakes the miner after a transaction entered the pool. Events
+// arriving while a block is being mined collapse into one.
+func NotifyMiner() {
+	select {
+	case newTxEvents <- struct{}{}:
+	default:
+	}
+}
+
+// Miner mines whenever the pool receives a transaction, and every interval
+// even when it is empty if interval is positive.
+func Miner(chain *blockchain.Blockchain, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-newTxEvents:
+			if memoryPool.Len() == 0 {
+				continue
+			}
+		case <-tick:
+		}
 		MineTx(chain)
 	}
 }
@@ -393,7 +601,7 @@ func HandleVersion(req *bytes.Buffer, chain *blockchain.Blockchain) {
 	bestHeight := chain.GetBestHeight()
 	otherHeight := payload.BestHeight
 	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
+		SendGetHeaders(payload.AddrFrom, chain.Locator())
 	} else if bestHeight > otherHeight {
 		SendVersion(payload.AddrFrom, chain)
 	}
@@ -413,19 +621,31 @@ func HandleConnection(conn net.Conn, chain *blockchain.Blockchain) {
 	if err != nil && err != io.EOF {
 		log.Panic(err)
 	}
+	// peers are scored by where the connection comes from, since the
+	// address in a message is whatever the sender wrote there
+	peer, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || IsBanned(peer) {
+		return
+	}
 	command := BytesToCommand(ExtractCommand(buff))
 	fmt.Printf("Recived %s command\n", command)
 	switch command {
 	case "addr":
 		HandleAddr(buff)
 	case "block":
-		Handleblocks(buff, chain)
+		Handleblocks(buff, chain, peer)
 	case "inv":
 		HandleInv(buff, chain)
 	case "getblocks":
 		HandleGetBlocks(buff, chain)
+	case "getdata":
+		HandleGetData(buff, chain)
+	case "getheaders":
+		HandleGetHeaders(buff, chain)
+	case "headers":
+		HandleHeaders(buff, chain, peer)
 	case "tx":
-		HandleTx(buff, chain)
+		HandleTx(buff, chain, peer)
 	case "version":
 		HandleVersion(buff, chain)
 	default:
@@ -433,7 +653,7 @@ func HandleConnection(conn net.Conn, chain *blockchain.Blockchain) {
 	}
 }
 
-func StartServer(nodeAddr, nodeId, minerAddress string) {
+func StartServer(nodeAddr, nodeId, minerAddress string, mineInterval time.Duration) {
 	nodeAddress = nodeAddr
 	mineAddress = minerAddress
 	ln, err := net.Listen(protocol, nodeAddr)
@@ -443,7 +663,14 @@ func StartServer(nodeAddr, nodeId, minerAddress string) {
 	defer ln.Close()
 	chain := blockchain.ContinueBlockChain(nodeId)
 	defer chain.Db.Close()
+	memoryPool = mempool.New(chain, nodeId)
+	if err := memoryPool.Load(); err != nil {
+		log.Printf("could not load mempool: %v", err)
+	}
 	go CloseDB(chain)
+	if len(mineAddress) > 0 {
+		go Miner(chain, mineInterval)
+	}
 	LoadKnownNodes()
 	if len(KnownNodeAddress) == 0 {
 		KnownNodeAddress = append(KnownNodeAddress, nodeAddr)
@@ -465,6 +692,9 @@ func CloseDB(chain *blockchain.Blockchain) {
 	d.WaitForDeathWithFunc(func() {
 		defer os.Exit(1)
 		defer runtime.Goexit()
+		if err := memoryPool.Save(); err != nil {
+			log.Printf("could not save mempool: %v", err)
+		}
 		chain.Db.Close()
 	})
 }
@@ -18,6 +18,11 @@ import (
 const (
 	ChecksumLength = 4
 	Version        = byte(0x01)
+	// version of addresses paying to the hash of a script, such as a
+	// multisig redeem script
+	ScriptVersion = byte(0x05)
+	// a public key is its X and Y coordinates, 32 bytes each
+	PublicKeyLength = 64
 )
 
 type Wallet struct {
@@ -44,31 +49,60 @@ func PublicKeyHash(pubKey []byte) []byte {
 }
 
 func (w *Wallet) Address() []byte {
-	pubKeyHash := PublicKeyHash(w.PublicKey)
-	verisionHash := append([]byte{Version}, pubKeyHash...)
+	return EncodeAddress(Version, PublicKeyHash(w.PublicKey))
+}
+
+func EncodeAddress(version byte, hash []byte) []byte {
+	verisionHash := append([]byte{version}, hash...)
 	checksum := Checksum(verisionHash)
 	fullhash := append(verisionHash, checksum...)
 	address := EncodeBase58(fullhash)
 	return address
 }
 
+// DecodeAddress splits an address into its version and hash. The address
+// must already have been checked with ValidateAddress.
+func DecodeAddress(address []byte) (byte, []byte) {
+	fullhash := DecodeBase58(address)
+	return fullhash[0], fullhash[1 : len(fullhash)-ChecksumLength]
+}
+
 func ValidateAddress(address []byte) bool {
 	pubKeyHash := DecodeBase58(address)
+	if len(pubKeyHash) <= 1+ChecksumLength {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-ChecksumLength:]
 	version := pubKeyHash[0]
+	if version != Version && version != ScriptVersion {
+		return false
+	}
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-ChecksumLength]
 	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
 
 	return bytes.Equal(actualChecksum, targetChecksum)
 }
 
+// PublicKeyBytes encodes a public key as X and Y, each padded to 32 bytes so
+// the two halves can always be told apart. Keys used to be written without
+// the padding, so a key with a coordinate starting with a zero byte now has
+// a different address. Outputs paid to the old address cannot be spent;
+// chains from before the change fail the database version check and are
+// synced again from scratch.
+func PublicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	b := make([]byte, PublicKeyLength)
+	pub.X.FillBytes(b[:PublicKeyLength/2])
+	pub.Y.FillBytes(b[PublicKeyLength/2:])
+	return b
+}
+
 func NewKeyPair() (*ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		log.Panic("could not generate keys for wallet")
 	}
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	pub := PublicKeyBytes(&private.PublicKey)
 	return private, pub
 }
 
@@ -112,7 +146,7 @@ func (w *Wallet) Load(filename string) error {
 	if err != nil {
 		return err
 	}
-	w.PublicKey = append(pk.PublicKey.X.Bytes(), pk.PublicKey.Y.Bytes()...)
+	w.PublicKey = PublicKeyBytes(&pk.PublicKey)
 	w.PrivateKey = *pk
 	return nil
 }